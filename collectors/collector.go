@@ -0,0 +1,31 @@
+package collectors
+
+const (
+	TypeGauge   string = "gauge"
+	TypeCounter string = "counter"
+)
+
+// Metadata of a metric family, used to render HELP and TYPE comments
+type MetricDesc struct {
+	Name      string // without the statexec_ prefix
+	Help      string
+	Type      string
+	Collector string // Name of the collector producing the family, set by the registry
+}
+
+// A single value of a metric family
+type Sample struct {
+	Name   string // without the statexec_ prefix
+	Labels map[string]string
+	Value  float64
+}
+
+type Collector interface {
+	// Name used to enable or disable the collector
+	Name() string
+	// Metric families produced by the collector
+	Describe() []MetricDesc
+	// Gather the current values, a failing collector is skipped for this
+	// collection only
+	Collect() ([]Sample, error)
+}
@@ -6,9 +6,22 @@ import (
 	"github.com/shirou/gopsutil/v3/cpu"
 )
 
-type CpuMetrics struct {
-	Cpu            string
-	CpuTimePerMode map[string]float64
+var cpuModes = []string{"user", "system", "idle", "nice", "iowait", "irq", "softirq", "steal", "guest", "guestNice"}
+
+type CpuCollector struct{}
+
+func NewCpuCollector() *CpuCollector {
+	return &CpuCollector{}
+}
+
+func (c *CpuCollector) Name() string {
+	return "cpu"
+}
+
+func (c *CpuCollector) Describe() []MetricDesc {
+	return []MetricDesc{
+		{Name: "cpu_seconds_total", Help: "CPU time spent in seconds", Type: TypeCounter},
+	}
 }
 
 // Get CPU time by state
@@ -39,25 +52,24 @@ func getCpuTimeByMode(cpuTimeStat *cpu.TimesStat, mode string) float64 {
 	}
 }
 
-func CollectCpuMetrics() []CpuMetrics {
-	var cpuMetrics []CpuMetrics
+func (c *CpuCollector) Collect() ([]Sample, error) {
+	var samples []Sample
 	cpuTimeStat, err := cpu.Times(true)
 	if err != nil {
-		fmt.Println("Error retrieving CPU Times:", err)
-		panic(err)
+		return nil, fmt.Errorf("retrieving CPU times: %w", err)
 	}
 
 	// CpuFreqStat, _ := cpu.Info()
 	// fmt.Println("cpuFreq object is %v", CpuFreqStat)
 
 	for _, cpuTime := range cpuTimeStat {
-		cpuTimePerMode := make(map[string]float64)
-		modes := []string{"user", "system", "idle", "nice", "iowait", "irq", "softirq", "steal", "guest", "guestNice"}
-		for _, mode := range modes {
-			cpuTimePerMode[mode] = getCpuTimeByMode(&cpuTime, mode)
+		for _, mode := range cpuModes {
+			samples = append(samples, Sample{
+				Name:   "cpu_seconds_total",
+				Labels: map[string]string{"cpu": cpuTime.CPU, "mode": mode},
+				Value:  getCpuTimeByMode(&cpuTime, mode),
+			})
 		}
-
-		cpuMetrics = append(cpuMetrics, CpuMetrics{Cpu: cpuTime.CPU, CpuTimePerMode: cpuTimePerMode})
 	}
-	return cpuMetrics
+	return samples, nil
 }
@@ -6,23 +6,37 @@ import (
 	"github.com/shirou/gopsutil/v3/disk"
 )
 
-type DiskMetrics struct {
-	Device          string
-	ReadBytesTotal  uint64
-	WriteBytesTotal uint64
+type DiskCollector struct{}
+
+func NewDiskCollector() *DiskCollector {
+	return &DiskCollector{}
+}
+
+func (c *DiskCollector) Name() string {
+	return "disk"
+}
+
+func (c *DiskCollector) Describe() []MetricDesc {
+	return []MetricDesc{
+		{Name: "disk_read_bytes_total", Help: "Total read bytes", Type: TypeCounter},
+		{Name: "disk_write_bytes_total", Help: "Total written bytes", Type: TypeCounter},
+	}
 }
 
-func CollectDiskMetrics() []DiskMetrics {
-	var diskMetrics []DiskMetrics
+func (c *DiskCollector) Collect() ([]Sample, error) {
+	var samples []Sample
 	diskStat, err := disk.IOCounters()
 	if err != nil {
-		fmt.Println("Error retrieving Disk IO Counters:", err)
-		panic(err)
+		return nil, fmt.Errorf("retrieving disk IO counters: %w", err)
 	}
 
 	for device, diskIO := range diskStat {
-		diskMetrics = append(diskMetrics, DiskMetrics{Device: device, ReadBytesTotal: diskIO.ReadBytes, WriteBytesTotal: diskIO.WriteBytes})
+		labels := map[string]string{"disk": device}
+		samples = append(samples,
+			Sample{Name: "disk_read_bytes_total", Labels: labels, Value: float64(diskIO.ReadBytes)},
+			Sample{Name: "disk_write_bytes_total", Labels: labels, Value: float64(diskIO.WriteBytes)},
+		)
 	}
 
-	return diskMetrics
+	return samples, nil
 }
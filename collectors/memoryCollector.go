@@ -6,30 +6,41 @@ import (
 	"github.com/shirou/gopsutil/v3/mem"
 )
 
-type MemoryMetrics struct {
-	Total       uint64
-	Available   uint64
-	Used        uint64
-	Free        uint64
-	Buffers     uint64
-	Cached      uint64
-	UsedPercent float64
+type MemoryCollector struct{}
+
+func NewMemoryCollector() *MemoryCollector {
+	return &MemoryCollector{}
+}
+
+func (c *MemoryCollector) Name() string {
+	return "memory"
 }
 
-func CollectMemoryMetrics() MemoryMetrics {
+func (c *MemoryCollector) Describe() []MetricDesc {
+	return []MetricDesc{
+		{Name: "memory_total_bytes", Help: "Total memory in bytes", Type: TypeGauge},
+		{Name: "memory_available_bytes", Help: "Available memory in bytes", Type: TypeGauge},
+		{Name: "memory_used_bytes", Help: "Used memory in bytes", Type: TypeGauge},
+		{Name: "memory_free_bytes", Help: "Free memory in bytes", Type: TypeGauge},
+		{Name: "memory_buffers_bytes", Help: "Memory buffers in bytes", Type: TypeGauge},
+		{Name: "memory_cached_bytes", Help: "Memory cached in bytes", Type: TypeGauge},
+		{Name: "memory_used_percent", Help: "Used memory in percent", Type: TypeGauge},
+	}
+}
+
+func (c *MemoryCollector) Collect() ([]Sample, error) {
 	vmStat, err := mem.VirtualMemory()
 	if err != nil {
-		fmt.Println("Error retrieving Virtual Memory Usage:", err)
-		panic(err)
+		return nil, fmt.Errorf("retrieving virtual memory usage: %w", err)
 	}
 
-	return MemoryMetrics{
-		Total:       vmStat.Total,
-		Available:   vmStat.Available,
-		Used:        vmStat.Used,
-		Free:        vmStat.Free,
-		Buffers:     vmStat.Buffers,
-		Cached:      vmStat.Cached,
-		UsedPercent: vmStat.UsedPercent,
-	}
+	return []Sample{
+		{Name: "memory_total_bytes", Value: float64(vmStat.Total)},
+		{Name: "memory_available_bytes", Value: float64(vmStat.Available)},
+		{Name: "memory_used_bytes", Value: float64(vmStat.Used)},
+		{Name: "memory_free_bytes", Value: float64(vmStat.Free)},
+		{Name: "memory_buffers_bytes", Value: float64(vmStat.Buffers)},
+		{Name: "memory_cached_bytes", Value: float64(vmStat.Cached)},
+		{Name: "memory_used_percent", Value: vmStat.UsedPercent},
+	}, nil
 }
@@ -6,23 +6,37 @@ import (
 	"github.com/shirou/gopsutil/v3/net"
 )
 
-type NetworkMetrics struct {
-	Interface      string
-	SentTotalBytes uint64
-	RecvTotalBytes uint64
+type NetworkCollector struct{}
+
+func NewNetworkCollector() *NetworkCollector {
+	return &NetworkCollector{}
+}
+
+func (c *NetworkCollector) Name() string {
+	return "network"
+}
+
+func (c *NetworkCollector) Describe() []MetricDesc {
+	return []MetricDesc{
+		{Name: "network_sent_bytes_total", Help: "Total sent bytes", Type: TypeCounter},
+		{Name: "network_received_bytes_total", Help: "Total received bytes", Type: TypeCounter},
+	}
 }
 
-func CollectNetworkMetrics() []NetworkMetrics {
-	var networkMetrics []NetworkMetrics
+func (c *NetworkCollector) Collect() ([]Sample, error) {
+	var samples []Sample
 	netStat, err := net.IOCounters(true)
 	if err != nil {
-		fmt.Println("Error retrieving Network IO Counters:", err)
-		panic(err)
+		return nil, fmt.Errorf("retrieving network IO counters: %w", err)
 	}
 
 	for _, netIO := range netStat {
-		networkMetrics = append(networkMetrics, NetworkMetrics{Interface: netIO.Name, SentTotalBytes: netIO.BytesSent, RecvTotalBytes: netIO.BytesRecv})
+		labels := map[string]string{"interface": netIO.Name}
+		samples = append(samples,
+			Sample{Name: "network_sent_bytes_total", Labels: labels, Value: float64(netIO.BytesSent)},
+			Sample{Name: "network_received_bytes_total", Labels: labels, Value: float64(netIO.BytesRecv)},
+		)
 	}
 
-	return networkMetrics
+	return samples, nil
 }
@@ -0,0 +1,214 @@
+package collectors
+
+import (
+	"math"
+	"sync"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// Cumulative counters of a single process, kept to account for processes
+// leaving the tree between two collections
+type processCounters struct {
+	ppid                   int32
+	cpuTimePerMode         map[string]float64
+	readBytesTotal         uint64
+	writeBytesTotal        uint64
+	voluntaryCtxSwitches   int64
+	involuntaryCtxSwitches int64
+}
+
+// ProcessCollector follows a process and all its descendants. Counters of
+// processes that exited are kept so that totals never go backwards, except
+// for I/O of processes reaped by a parent of the tree: the kernel already
+// adds it to the I/O of the parent.
+type ProcessCollector struct {
+	mutex    sync.Mutex
+	pid      int32
+	lastSeen map[int32]processCounters
+	exited   processCounters
+}
+
+func NewProcessCollector() *ProcessCollector {
+	return &ProcessCollector{
+		lastSeen: make(map[int32]processCounters),
+		exited:   processCounters{cpuTimePerMode: make(map[string]float64)},
+	}
+}
+
+func (c *ProcessCollector) Name() string {
+	return "process"
+}
+
+func (c *ProcessCollector) Describe() []MetricDesc {
+	return []MetricDesc{
+		{Name: "process_count", Help: "Number of processes in the command process tree", Type: TypeGauge},
+		{Name: "process_cpu_seconds_total", Help: "CPU time spent by the command process tree in seconds", Type: TypeCounter},
+		{Name: "process_resident_memory_bytes", Help: "Resident memory (RSS) of the command process tree in bytes", Type: TypeGauge},
+		{Name: "process_proportional_memory_bytes", Help: "Proportional set size (PSS) of the command process tree in bytes", Type: TypeGauge},
+		{Name: "process_virtual_memory_bytes", Help: "Virtual memory size of the command process tree in bytes", Type: TypeGauge},
+		{Name: "process_threads", Help: "Number of threads of the command process tree", Type: TypeGauge},
+		{Name: "process_open_fds", Help: "Number of open file descriptors of the command process tree", Type: TypeGauge},
+		{Name: "process_read_bytes_total", Help: "Total bytes read by the command process tree", Type: TypeCounter},
+		{Name: "process_write_bytes_total", Help: "Total bytes written by the command process tree", Type: TypeCounter},
+		{Name: "process_context_switches_total", Help: "Total context switches of the command process tree", Type: TypeCounter},
+	}
+}
+
+// Follow the process tree rooted at pid, 0 stops following
+func (c *ProcessCollector) Follow(pid int32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pid = pid
+}
+
+// Find pid and all its descendants
+func getProcessTree(pid int32) []*process.Process {
+	root, err := process.NewProcess(pid)
+	if err != nil {
+		return nil
+	}
+
+	childrenByParent := make(map[int32][]*process.Process)
+	allProcesses, err := process.Processes()
+	if err == nil {
+		for _, p := range allProcesses {
+			ppid, err := p.Ppid()
+			if err != nil {
+				continue
+			}
+			childrenByParent[ppid] = append(childrenByParent[ppid], p)
+		}
+	}
+
+	tree := []*process.Process{root}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, childrenByParent[tree[i].Pid]...)
+	}
+	return tree
+}
+
+// Processes may exit while we read them, every error is ignored and the
+// corresponding value is left out of the totals
+func (c *ProcessCollector) Collect() ([]Sample, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Nothing to report while no command is followed
+	if c.pid == 0 {
+		return nil, nil
+	}
+
+	var processCount, threads, openFds int64
+	var residentBytes, proportionalBytes, virtualBytes uint64
+	seen := make(map[int32]processCounters)
+
+	for _, p := range getProcessTree(c.pid) {
+		counters := processCounters{cpuTimePerMode: make(map[string]float64)}
+
+		if ppid, err := p.Ppid(); err == nil {
+			counters.ppid = ppid
+		}
+		if cpuTimeStat, err := p.Times(); err == nil {
+			counters.cpuTimePerMode["user"] = cpuTimeStat.User
+			counters.cpuTimePerMode["system"] = cpuTimeStat.System
+			counters.cpuTimePerMode["iowait"] = cpuTimeStat.Iowait
+		}
+		if ioStat, err := p.IOCounters(); err == nil {
+			counters.readBytesTotal = ioStat.ReadBytes
+			counters.writeBytesTotal = ioStat.WriteBytes
+		}
+		if ctxSwitches, err := p.NumCtxSwitches(); err == nil {
+			counters.voluntaryCtxSwitches = ctxSwitches.Voluntary
+			counters.involuntaryCtxSwitches = ctxSwitches.Involuntary
+		}
+		if memInfo, err := p.MemoryInfo(); err == nil {
+			residentBytes += memInfo.RSS
+			virtualBytes += memInfo.VMS
+		}
+		if memMaps, err := p.MemoryMaps(true); err == nil && len(*memMaps) > 0 {
+			proportionalBytes += (*memMaps)[0].Pss * 1024
+		}
+		if numThreads, err := p.NumThreads(); err == nil {
+			threads += int64(numThreads)
+		}
+		if fds, err := p.NumFDs(); err == nil {
+			openFds += int64(fds)
+		}
+
+		// Exiting processes report zeroed counters, keep the last known ones
+		if previous, ok := c.lastSeen[p.Pid]; ok {
+			counters.keepMax(previous)
+		}
+
+		seen[p.Pid] = counters
+		processCount++
+	}
+
+	// Keep the last known counters of processes which left the tree. CPU
+	// time and context switches of reaped children are not added to their
+	// parent, I/O is: it is only kept when the parent is not in the tree,
+	// e.g. for the command itself or orphans reaped by init.
+	for pid, counters := range c.lastSeen {
+		if _, ok := seen[pid]; !ok {
+			if _, ok := seen[counters.ppid]; ok {
+				counters.readBytesTotal = 0
+				counters.writeBytesTotal = 0
+			}
+			c.exited.add(counters)
+		}
+	}
+	c.lastSeen = seen
+
+	totals := processCounters{cpuTimePerMode: make(map[string]float64)}
+	totals.add(c.exited)
+	for _, counters := range seen {
+		totals.add(counters)
+	}
+
+	samples := []Sample{
+		{Name: "process_count", Value: float64(processCount)},
+	}
+	for _, mode := range []string{"user", "system", "iowait"} {
+		samples = append(samples, Sample{
+			Name:   "process_cpu_seconds_total",
+			Labels: map[string]string{"mode": mode},
+			Value:  totals.cpuTimePerMode[mode],
+		})
+	}
+	samples = append(samples,
+		Sample{Name: "process_resident_memory_bytes", Value: float64(residentBytes)},
+		Sample{Name: "process_proportional_memory_bytes", Value: float64(proportionalBytes)},
+		Sample{Name: "process_virtual_memory_bytes", Value: float64(virtualBytes)},
+		Sample{Name: "process_threads", Value: float64(threads)},
+		Sample{Name: "process_open_fds", Value: float64(openFds)},
+		Sample{Name: "process_read_bytes_total", Value: float64(totals.readBytesTotal)},
+		Sample{Name: "process_write_bytes_total", Value: float64(totals.writeBytesTotal)},
+		Sample{Name: "process_context_switches_total", Labels: map[string]string{"type": "voluntary"}, Value: float64(totals.voluntaryCtxSwitches)},
+		Sample{Name: "process_context_switches_total", Labels: map[string]string{"type": "involuntary"}, Value: float64(totals.involuntaryCtxSwitches)},
+	)
+	return samples, nil
+}
+
+func (c *processCounters) add(other processCounters) {
+	for mode, cpuTime := range other.cpuTimePerMode {
+		c.cpuTimePerMode[mode] += cpuTime
+	}
+	c.readBytesTotal += other.readBytesTotal
+	c.writeBytesTotal += other.writeBytesTotal
+	c.voluntaryCtxSwitches += other.voluntaryCtxSwitches
+	c.involuntaryCtxSwitches += other.involuntaryCtxSwitches
+}
+
+func (c *processCounters) keepMax(other processCounters) {
+	if c.ppid == 0 {
+		c.ppid = other.ppid
+	}
+	for mode, cpuTime := range other.cpuTimePerMode {
+		c.cpuTimePerMode[mode] = math.Max(c.cpuTimePerMode[mode], cpuTime)
+	}
+	c.readBytesTotal = max(c.readBytesTotal, other.readBytesTotal)
+	c.writeBytesTotal = max(c.writeBytesTotal, other.writeBytesTotal)
+	c.voluntaryCtxSwitches = max(c.voluntaryCtxSwitches, other.voluntaryCtxSwitches)
+	c.involuntaryCtxSwitches = max(c.involuntaryCtxSwitches, other.involuntaryCtxSwitches)
+}
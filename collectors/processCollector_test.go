@@ -0,0 +1,70 @@
+package collectors
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func sampleValue(samples []Sample, name string) float64 {
+	for _, sample := range samples {
+		if sample.Name == name {
+			return sample.Value
+		}
+	}
+	return -1
+}
+
+// Children and grandchildren writing to disk, all reaped inside the tree,
+// must be counted once
+func TestProcessCollectorForkingWorkloadIO(t *testing.T) {
+	if _, err := exec.LookPath("dd"); err != nil {
+		t.Skip("dd not found")
+	}
+	const chunkBytes = 4 * 1024 * 1024
+	write := "dd if=/dev/zero of=" + t.TempDir() + "/out bs=1M count=4 conv=fsync status=none"
+	cmd := exec.Command("sh", "-c", write+"; sleep 0.3; "+
+		"sh -c '"+write+"; sleep 0.3'; sleep 0.3; "+
+		"sh -c 'sh -c \""+write+"\"; sleep 0.3'; sleep 0.5")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	collector := NewProcessCollector()
+	collector.Follow(int32(cmd.Process.Pid))
+	previous := 0.0
+	check := func() {
+		samples, err := collector.Collect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		written := sampleValue(samples, "process_write_bytes_total")
+		if written < previous {
+			t.Fatalf("process_write_bytes_total went backwards from %.0f to %.0f", previous, written)
+		}
+		previous = written
+	}
+	for running := true; running; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			running = false
+		case <-time.After(50 * time.Millisecond):
+			check()
+		}
+	}
+	// The command left the tree, its last counters are kept
+	check()
+
+	if previous == 0 {
+		t.Skip("the filesystem of the temporary directory does not account written bytes")
+	}
+	expected := 3.0 * chunkBytes
+	if previous < expected || previous > expected*1.1 {
+		t.Errorf("process_write_bytes_total = %.0f, expected about %.0f", previous, expected)
+	}
+}
@@ -0,0 +1,158 @@
+package collectors
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Metric family reporting failed collections
+var collectorErrorsDesc = MetricDesc{Name: "collector_errors_total", Help: "Total number of failed collections per collector", Type: TypeCounter}
+
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []Collector
+	disabled   map[string]bool
+	errors     map[string]int
+	lastError  map[string]string
+}
+
+func NewRegistry(collectors ...Collector) *Registry {
+	registry := &Registry{
+		disabled:  make(map[string]bool),
+		errors:    make(map[string]int),
+		lastError: make(map[string]string),
+	}
+	for _, collector := range collectors {
+		registry.Register(collector)
+	}
+	return registry
+}
+
+// Register a collector, enabled by default
+func (r *Registry) Register(collector Collector) {
+	r.collectors = append(r.collectors, collector)
+}
+
+// Names of all registered collectors, in registration order
+func (r *Registry) Names() []string {
+	var names []string
+	for _, collector := range r.collectors {
+		names = append(names, collector.Name())
+	}
+	return names
+}
+
+// Enabled collectors, in registration order
+func (r *Registry) Enabled() []Collector {
+	var enabled []Collector
+	for _, collector := range r.collectors {
+		if !r.disabled[collector.Name()] {
+			enabled = append(enabled, collector)
+		}
+	}
+	return enabled
+}
+
+// Configure enabled collectors from a comma separated list of names.
+// Names prefixed with "-" are disabled, e.g. "-disk,-network". As soon as
+// one name is given without prefix, only listed collectors are enabled,
+// e.g. "cpu,memory".
+func (r *Registry) Configure(spec string) error {
+	var enable []string
+	var disable []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.HasPrefix(name, "-") {
+			disable = append(disable, strings.TrimPrefix(name, "-"))
+		} else {
+			enable = append(enable, name)
+		}
+	}
+
+	for _, name := range append(enable, disable...) {
+		if !r.has(name) {
+			return fmt.Errorf("unknown collector %q (available: %s)", name, strings.Join(r.Names(), ", "))
+		}
+	}
+
+	if len(enable) > 0 {
+		for _, collector := range r.collectors {
+			r.disabled[collector.Name()] = true
+		}
+		for _, name := range enable {
+			delete(r.disabled, name)
+		}
+	}
+	for _, name := range disable {
+		r.disabled[name] = true
+	}
+	return nil
+}
+
+// Metric families of enabled collectors
+func (r *Registry) Describe() []MetricDesc {
+	var descs []MetricDesc
+	for _, collector := range r.Enabled() {
+		for _, desc := range collector.Describe() {
+			desc.Collector = collector.Name()
+			descs = append(descs, desc)
+		}
+	}
+	return append(descs, collectorErrorsDesc)
+}
+
+// Gather samples from all enabled collectors. A failing collector is
+// skipped and counted in the collector_errors_total metric family.
+func (r *Registry) Collect() []Sample {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var samples []Sample
+	for _, collector := range r.Enabled() {
+		collectorSamples, err := safeCollect(collector)
+		if err != nil {
+			r.errors[collector.Name()]++
+			// Only report an error once until it changes, collection may fail on every tick
+			if err.Error() != r.lastError[collector.Name()] {
+				fmt.Fprintf(os.Stderr, "Error collecting %s metrics: %s\n", collector.Name(), err)
+				r.lastError[collector.Name()] = err.Error()
+			}
+			continue
+		}
+		samples = append(samples, collectorSamples...)
+	}
+
+	for _, collector := range r.Enabled() {
+		samples = append(samples, Sample{
+			Name:   collectorErrorsDesc.Name,
+			Labels: map[string]string{"collector": collector.Name()},
+			Value:  float64(r.errors[collector.Name()]),
+		})
+	}
+	return samples
+}
+
+// Collect from a collector, turning a panic into an error
+func safeCollect(collector Collector) (samples []Sample, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			samples = nil
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return collector.Collect()
+}
+
+func (r *Registry) has(name string) bool {
+	for _, collector := range r.collectors {
+		if collector.Name() == name {
+			return true
+		}
+	}
+	return false
+}
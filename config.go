@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/blackswifthosting/statexec/runner"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration file, applied before environment variables and flags
+var configPath string
+
+// Command and arguments from the configuration file, used when none is given on the command line
+var configCommand []string
+
+// Find the configuration file from SE_CONFIG or --config, which takes precedence.
+// Flags are only scanned up to the command, invalid ones are reported by parseArgs.
+func findConfigPath(args []string) string {
+	path := os.Getenv(EnvVarPrefix + "CONFIG")
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		name, value, hasValue := arg, "", false
+		if strings.HasPrefix(arg, "--") {
+			name, value, hasValue = strings.Cut(arg, "=")
+		}
+		opt := findOption(name)
+		if opt == nil {
+			continue
+		}
+		if opt.arg != "" && !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		if opt.names[0] == "--config" {
+			path = value
+		}
+	}
+	return path
+}
+
+// Load a YAML or TOML configuration file, keys are the long option names
+func loadConfigFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(content, &values)
+	default:
+		err = yaml.Unmarshal(content, &values)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	// Apply keys in a stable order, so that errors are reproducible
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := applyConfigValue(key, values[key]); err != nil {
+			return fmt.Errorf("%s: key %q: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+func applyConfigValue(key string, value any) error {
+	switch key {
+	case "labels":
+		labels, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("expected a map of labels")
+		}
+		for labelKey, labelValue := range labels {
+			if err := addLabel(labelKey, fmt.Sprint(labelValue)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "command":
+		command, err := configStrings(value)
+		if err != nil {
+			return err
+		}
+		configCommand = command
+		return nil
+
+	case "collectors":
+		// Also accepted as a list
+		if list, ok := value.([]any); ok {
+			names, err := configStrings(list)
+			if err != nil {
+				return err
+			}
+			value = strings.Join(names, ",")
+		}
+	}
+
+	opt := findOption("--" + key)
+	if opt == nil || opt.env == "" || key == "label" || key == "config" {
+		return fmt.Errorf("unknown key")
+	}
+	stringValue, err := configString(value)
+	if err != nil {
+		return err
+	}
+	return opt.set(stringValue)
+}
+
+// Render a scalar value as it would be given on the command line
+func configString(value any) (string, error) {
+	switch typed := value.(type) {
+	case string:
+		return typed, nil
+	case bool:
+		return strconv.FormatBool(typed), nil
+	case int, int64, uint64, float64:
+		return fmt.Sprint(typed), nil
+	case time.Time:
+		return typed.Format(time.RFC3339Nano), nil
+	}
+	return "", fmt.Errorf("expected a single value, found %v", value)
+}
+
+// A list of values, or a single value
+func configStrings(value any) ([]string, error) {
+	list, ok := value.([]any)
+	if !ok {
+		list = []any{value}
+	}
+	var values []string
+	for _, item := range list {
+		stringValue, err := configString(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, stringValue)
+	}
+	return values, nil
+}
+
+// Configuration resolved from defaults, configuration file, environment and
+// flags, in YAML so that it can be used as a configuration file
+func resolvedConfig(cmd []string) string {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	add := func(key string, value any) {
+		var valueNode yaml.Node
+		if err := valueNode.Encode(value); err != nil {
+			return
+		}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &valueNode)
+	}
+
+	add("file", metricsFile)
+	add("format", strings.Join(outputFormats, ","))
+	if traceFile != "" {
+		add("trace-out", traceFile)
+	}
+	if summaryMarkdownFile != "" {
+		add("summary-markdown", summaryMarkdownFile)
+	}
+	if runOptions.Instance != "" {
+		add("instance", runOptions.Instance)
+	}
+	if runOptions.MetricsStartTime != 0 {
+		add("metrics-start-time", time.UnixMilli(runOptions.MetricsStartTime).UTC().Format(time.RFC3339Nano))
+	}
+	add("delay-before-command", runOptions.DelayBeforeCommand.String())
+	add("delay-after-command", runOptions.DelayAfterCommand.String())
+	add("interval", runOptions.Interval.String())
+	enabled, _ := runner.CollectorNames(runOptions.Collectors)
+	add("collectors", strings.Join(enabled, ","))
+	if len(runOptions.Labels) > 0 {
+		add("labels", runOptions.Labels)
+	}
+
+	switch role {
+	case "server":
+		add("server", true)
+	case "client":
+		add("connect", serverIp)
+		add("delay-before-sync", delayBeforeSync.String())
+		add("sync-until-succeed", syncUntilSucceed)
+	}
+	if role != "standalone" {
+		add("sync-port", syncPort)
+		add("sync-start-only", !syncWaitForStop)
+	}
+
+	if runOptions.CommandTimeout > 0 {
+		add("command-timeout", runOptions.CommandTimeout.String())
+		add("timeout-signal", runner.SignalName(runOptions.TimeoutSignal))
+		add("kill-after", runOptions.KillAfter.String())
+	}
+	if runOptions.ForwardSignal != 0 {
+		add("forward-signal", runner.SignalName(runOptions.ForwardSignal))
+	}
+	add("grace-period", runOptions.GracePeriod.String())
+	// Credentials are left out, the configuration is written in the metrics file
+	if remoteWrite.url != "" {
+		add("remote-write-url", remoteWrite.url)
+		if remoteWrite.username != "" {
+			add("remote-write-username", remoteWrite.username)
+		}
+	}
+	if influx.url != "" {
+		add("influx-url", influx.url)
+		add("influx-org", influx.org)
+		add("influx-bucket", influx.bucket)
+	}
+	if otlp.endpoint != "" {
+		add("otlp-endpoint", otlp.endpoint)
+		add("otlp-protocol", otlp.protocol)
+		add("otlp-insecure", otlp.insecure)
+	}
+	if listenAddress != "" {
+		add("listen", listenAddress)
+	}
+	if logFilePath != "" {
+		add("log-file", logFilePath)
+	}
+	if tui {
+		add("tui", tui)
+	}
+	add("command", cmd)
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return ""
+	}
+	encoder.Close()
+	return buffer.String()
+}
@@ -1,71 +1,34 @@
 #!/bin/bash
 
-CURDIR=$(dirname $0)
-[ "$CURDIR" = "." ] && CURDIR=$(pwd)
+CURDIR=$(cd $(dirname $0) && pwd)
 
 VMSERVER=${VMSERVER:-http://localhost:8428}
+GRAFANASERVER=${GRAFANASERVER:-http://localhost:3000}
 DOCKERCOMPOSE_CMD=$(docker-compose version >/dev/null 2>&1 && echo "docker-compose" || echo "docker compose")
 
-DASHBOARDURL="http://localhost:3000/d/statexec/statexec-dashboard"
-
-function waitForVM {
-    echo "Waiting for VictoriaMetrics to start"
-    while ! curl -s ${VMSERVER}/health -o /dev/null; do
-        echo -n "."
-        sleep 1
-    done
-    echo
-}
-
-function waitForGrafana {
-    echo "Waiting for Grafana to start"
-    while ! curl -s http://localhost:3000/api/health -o /dev/null; do
-        echo -n "."
-        sleep 1
-    done
-    echo
+DASHBOARDURL="${GRAFANASERVER}/d/statexec/statexec-dashboard"
+
+# statexec from the PATH, or built from this repository
+function statexec {
+    if [ -n "$STATEXEC" ]; then
+        $STATEXEC "$@"
+    elif type -P statexec >/dev/null 2>&1; then
+        command statexec "$@"
+    else
+        (cd $CURDIR/.. && go run . "$@")
+    fi
 }
 
-# Import Prometheus exposition format
+# Import metrics into VictoriaMetrics and annotations into Grafana
 function importPromFile {
-    import=$1
-    [ "$import" = "" ] && import=$CURDIR/import
-
-    waitForVM
-    waitForGrafana
-
-    tmpfile=$(mktemp)
-    find $import -type f -name "*.prom" -print0 | while IFS= read -r -d '' file; do
-        
-        # Find instance name
-        instance=$(grep -Eo 'instance="[^"]+"' $file | head -n 1 | awk -F'"' '{print $2}'  )
-        role=$(grep -Eo 'role="[^"]+"' $file | head -n 1 | awk -F'"' '{print $2}'  )
-
-        # Prometheus metrics
-        curl -X POST ${VMSERVER}/api/v1/import/prometheus -T "$file" \
-            || { echo "Cannot import $file" ;  exit 1; }
-
-        # Grafana annotations
-        grep "^#grafana-annotation" $file | while IFS= read -r line; do
-            # Format: #grafana-annotation <annotation>
-            annotation=$(echo $line | sed 's/^#grafana-annotation //')
-            curl -so /dev/null -X POST -H "Content-Type: application/json" -d "${annotation}" http://localhost:3000/api/annotations \
-                || { echo "Cannot create grafana annotations from $file" ;  exit 1; }
-        done
-
-        startTime=$(grep "^statexec_metric_collect_duration_ms" $file | sed -e 's/.*\} .* //' | head -n 1)
-        endTime=$(grep "^statexec_metric_collect_duration_ms" $file | sed -e 's/.*\} .* //' | tail -n 1)
-        echo "View stats for $file : ${DASHBOARDURL}?orgId=1&from=${startTime}&to=${endTime}&var-instance=${instance}&var-role=${role}"
-        echo -e "${startTime}\n${endTime}" >> $tmpfile
-    done
-
-    minStartTime=$(cat $tmpfile | sort -n | head -n 1)
-    maxEndTime=$(cat $tmpfile | sort -n | tail -n 1)
-    rm $tmpfile
-    
-    maxEndTime=$(( ${maxEndTime} + 1000 ))
-
-    open "${DASHBOARDURL}?orgId=1&from=${minStartTime}&to=${maxEndTime}"
+    import=${1:-$CURDIR/import}
+    # go run changes the working directory
+    case "$import" in
+        /*) ;;
+        *) import="$(pwd)/$import" ;;
+    esac
+
+    statexec import --vm-url ${VMSERVER} --grafana-url ${GRAFANASERVER} --wait 2m "$import"
 }
 
 function start {
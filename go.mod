@@ -2,7 +2,13 @@ module github.com/blackswifthosting/statexec
 
 go 1.21.1
 
-require github.com/shirou/gopsutil/v3 v3.23.12
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/golang/snappy v1.0.0
+	github.com/shirou/gopsutil/v3 v3.23.12
+	golang.org/x/net v0.20.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/go-ole/go-ole v1.2.6 // indirect
@@ -13,4 +19,5 @@ require (
 	github.com/tklauser/numcpus v0.7.0 // indirect
 	github.com/yusufpapurcu/wmi v1.2.3 // indirect
 	golang.org/x/sys v0.16.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 )
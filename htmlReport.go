@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blackswifthosting/statexec/promfile"
+)
+
+// Colors of the chart lines, as in the default Grafana palette
+var chartColors = []string{"#7eb26d", "#eab839", "#6ed0e0", "#ef843c", "#e24d42", "#1f78c1", "#ba43a9", "#705da0", "#508642", "#cca300"}
+
+const (
+	chartWidth  = 860
+	chartHeight = 220
+	chartLeft   = 80 // Room for the values axis
+	chartBottom = 24 // Room for the time axis
+	chartTop    = 10
+	chartRight  = 10
+)
+
+// A line of a chart, points are milliseconds since the start of the run and values
+type chartSeries struct {
+	name   string
+	points [][2]float64
+}
+
+type htmlChart struct {
+	Title  string
+	Svg    template.HTML
+	Legend []htmlLegend
+}
+
+type htmlLegend struct {
+	Name  string
+	Color string
+}
+
+type htmlAnnotation struct {
+	Offset string
+	Text   string
+}
+
+type htmlRun struct {
+	Title       string
+	Metadata    [][2]string
+	Charts      []htmlChart
+	Annotations []htmlAnnotation
+	Summary     [][2]string
+	Config      string
+}
+
+type htmlReport struct {
+	Version   string
+	Generated string
+	Runs      []htmlRun
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>statexec report{{range .Runs}} - {{.Title}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h2 { border-bottom: 1px solid #ccc; padding-bottom: 4px; margin-top: 2em; }
+table { border-collapse: collapse; margin: 0.5em 0 1em; }
+td, th { padding: 2px 12px 2px 0; text-align: left; vertical-align: top; }
+td.value { text-align: right; font-family: monospace; }
+.chart { margin: 1em 0; }
+.chart h3 { margin: 0 0 4px; font-size: 1em; }
+.legend span { margin-right: 1em; font-size: 0.85em; }
+.legend i { display: inline-block; width: 12px; height: 3px; margin-right: 4px; vertical-align: middle; }
+svg text { font-size: 11px; fill: #555; }
+pre { background: #f5f5f5; padding: 0.5em; white-space: pre-wrap; }
+.footer { color: #888; font-size: 0.8em; margin-top: 3em; }
+</style>
+</head>
+<body>
+<h1>statexec report</h1>
+{{range .Runs}}
+<h2>{{.Title}}</h2>
+<table>
+{{range .Metadata}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}</table>
+{{range .Charts}}<div class="chart">
+<h3>{{.Title}}</h3>
+{{.Svg}}
+<div class="legend">{{range .Legend}}<span><i style="background: {{.Color}}"></i>{{.Name}}</span>{{end}}</div>
+</div>
+{{end}}
+{{if .Annotations}}<h3>Annotations</h3>
+<table>
+{{range .Annotations}}<tr><td class="value">{{.Offset}}</td><td><pre>{{.Text}}</pre></td></tr>
+{{end}}</table>
+{{end}}
+{{if .Summary}}<h3>Summary</h3>
+<table>
+{{range .Summary}}<tr><td>{{index . 0}}</td><td class="value">{{index . 1}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Config}}<details><summary>Configuration</summary><pre>{{.Config}}</pre></details>{{end}}
+{{end}}
+<p class="footer">Generated by statexec {{.Version}} on {{.Generated}}</p>
+</body>
+</html>
+`))
+
+// Write a self-contained HTML report of the runs of metrics files
+func writeHtmlReport(path string, names []string, files []*promfile.File) error {
+	report := htmlReport{Version: version, Generated: time.Now().UTC().Format(time.RFC3339)}
+	for i, file := range files {
+		for _, run := range reportRuns(file) {
+			report.Runs = append(report.Runs, htmlReportRun(names[i], file, run))
+		}
+	}
+
+	output, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := htmlReportTemplate.Execute(output, report); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+func htmlReportRun(name string, file *promfile.File, run reportRun) htmlRun {
+	var samples []promfile.Sample
+	var summary [][2]string
+	for _, sample := range file.Samples {
+		if !run.matches(sample) {
+			continue
+		}
+		samples = append(samples, sample)
+		if strings.HasPrefix(sample.Name, promfile.SummaryPrefix) {
+			summary = append(summary, [2]string{reportSampleName(sample), formatReportValue(sample.Value)})
+		}
+	}
+	runFile := &promfile.File{Samples: samples}
+	start, end := runFile.TimeRange()
+
+	result := htmlRun{
+		Title:   fmt.Sprintf("%s (%s) of %s", run.instance, run.role, name),
+		Summary: summary,
+		Config:  file.Config,
+	}
+	result.Metadata = append(result.Metadata,
+		[2]string{"From", formatTimestamp(start)},
+		[2]string{"To", formatTimestamp(end)},
+		[2]string{"Duration", (time.Duration(end-start) * time.Millisecond).String()},
+	)
+	if exitCodes := runFile.Series("command_exit_code"); len(exitCodes) > 0 {
+		result.Metadata = append(result.Metadata, [2]string{"Exit code", formatReportValue(exitCodes[0].Value)})
+	}
+	if durations := runFile.Series("command_duration_seconds"); len(durations) > 0 {
+		result.Metadata = append(result.Metadata, [2]string{"Command duration", formatReportValue(durations[0].Value) + "s"})
+	}
+	if len(samples) > 0 {
+		result.Metadata = append(result.Metadata, [2]string{"Job", samples[0].Label("job")})
+	}
+	for _, key := range []string{"Version", "Interval", "Merged"} {
+		if value := file.Header[key]; value != "" {
+			result.Metadata = append(result.Metadata, [2]string{key, value})
+		}
+	}
+
+	var annotations []promfile.Annotation
+	for _, annotation := range file.Annotations {
+		if annotation.Tag("instance") == run.instance && annotation.Tag("role") == run.role {
+			annotations = append(annotations, annotation)
+			result.Annotations = append(result.Annotations, htmlAnnotation{
+				Offset: "+" + (time.Duration(annotation.Time-start) * time.Millisecond).String(),
+				Text:   annotation.Text,
+			})
+		}
+	}
+
+	// Panels of the statexec Grafana dashboard
+	var cpu []chartSeries
+	for _, series := range counterRates(runFile, start, "cpu_seconds_total", "mode", 1) {
+		if series.name != "idle" && !allZero(series) {
+			cpu = append(cpu, series)
+		}
+	}
+	var memory []chartSeries
+	for _, name := range []string{"used", "buffers", "cached", "total"} {
+		memory = append(memory, gaugeSeries(runFile, start, "memory_"+name+"_bytes", name)...)
+	}
+	var network []chartSeries
+	for _, direction := range []string{"received", "sent"} {
+		for _, series := range counterRates(runFile, start, "network_"+direction+"_bytes_total", "interface", 8) {
+			if !allZero(series) {
+				series.name = direction + " " + series.name
+				network = append(network, series)
+			}
+		}
+	}
+	var disk []chartSeries
+	for _, direction := range []string{"read", "write"} {
+		for _, series := range counterRates(runFile, start, "disk_"+direction+"_bytes_total", "disk", 1) {
+			if !allZero(series) {
+				series.name = direction + " " + series.name
+				disk = append(disk, series)
+			}
+		}
+	}
+	for _, chart := range []struct {
+		title  string
+		unit   string
+		series []chartSeries
+	}{
+		{"CPU (cores)", "cores", cpu},
+		{"Memory", "B", memory},
+		{"Network bandwidth", "b/s", network},
+		{"Disk bandwidth", "B/s", disk},
+	} {
+		result.Charts = append(result.Charts, renderChart(chart.title, chart.unit, chart.series, end-start, start, annotations))
+	}
+	return result
+}
+
+// Values of a family summed by the value of a label, by timestamp
+func sumByLabel(file *promfile.File, name string, groupBy string) map[string]map[int64]float64 {
+	sums := make(map[string]map[int64]float64)
+	for _, sample := range file.Series(name) {
+		group := sample.Label(groupBy)
+		if sums[group] == nil {
+			sums[group] = make(map[int64]float64)
+		}
+		sums[group][sample.Timestamp] += sample.Value
+	}
+	return sums
+}
+
+// Points of a series in time order, relative to the start
+func sortedPoints(values map[int64]float64, start int64) [][2]float64 {
+	var timestamps []int64
+	for timestamp := range values {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	points := make([][2]float64, len(timestamps))
+	for i, timestamp := range timestamps {
+		points[i] = [2]float64{float64(timestamp - start), values[timestamp]}
+	}
+	return points
+}
+
+// Series of a gauge summed over its labels, none if the family has no samples
+func gaugeSeries(file *promfile.File, start int64, name string, seriesName string) []chartSeries {
+	values := sumByLabel(file, name, "")[""]
+	if len(values) == 0 {
+		return nil
+	}
+	return []chartSeries{{name: seriesName, points: sortedPoints(values, start)}}
+}
+
+// Per second rate of a counter, by value of a label, multiplied by factor
+func counterRates(file *promfile.File, start int64, name string, groupBy string, factor float64) []chartSeries {
+	sums := sumByLabel(file, name, groupBy)
+	var groups []string
+	for group := range sums {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	var result []chartSeries
+	for _, group := range groups {
+		points := sortedPoints(sums[group], start)
+		series := chartSeries{name: group}
+		for i := 1; i < len(points); i++ {
+			seconds := (points[i][0] - points[i-1][0]) / 1000
+			delta := points[i][1] - points[i-1][1]
+			// Counter reset, e.g. an interface coming back
+			if seconds <= 0 || delta < 0 {
+				continue
+			}
+			series.points = append(series.points, [2]float64{points[i][0], delta / seconds * factor})
+		}
+		if len(series.points) > 0 {
+			result = append(result, series)
+		}
+	}
+	return result
+}
+
+func allZero(series chartSeries) bool {
+	for _, point := range series.points {
+		if point[1] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Render a line chart as inline SVG, annotations are vertical markers.
+// Series without activity are left out by the caller.
+func renderChart(title string, unit string, series []chartSeries, duration int64, start int64, annotations []promfile.Annotation) htmlChart {
+	maxValue := 0.0
+	for _, line := range series {
+		for _, point := range line.points {
+			maxValue = math.Max(maxValue, point[1])
+		}
+	}
+	maxValue = niceCeiling(maxValue)
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	plotHeight := float64(chartHeight - chartTop - chartBottom)
+	x := func(offset float64) float64 {
+		if duration <= 0 {
+			return chartLeft
+		}
+		return chartLeft + offset/float64(duration)*plotWidth
+	}
+	y := func(value float64) float64 {
+		return chartTop + plotHeight - value/maxValue*plotHeight
+	}
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(&svg, `<title>%s</title>`, template.HTMLEscapeString(title))
+
+	// Grid and values axis
+	for i := 0; i <= 4; i++ {
+		value := maxValue * float64(i) / 4
+		fmt.Fprintf(&svg, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#e5e5e5"/>`, chartLeft, y(value), chartWidth-chartRight, y(value))
+		fmt.Fprintf(&svg, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`, chartLeft-6, y(value)+4, template.HTMLEscapeString(formatChartValue(value, unit)))
+	}
+
+	// Time axis, offsets since the start of the run
+	for i := 0; i <= 5; i++ {
+		offset := float64(duration) * float64(i) / 5
+		label := "+" + (time.Duration(offset) * time.Millisecond).Round(time.Second/10).String()
+		fmt.Fprintf(&svg, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`, x(offset), chartHeight-6, label)
+	}
+
+	// Annotations, with their text as tooltip
+	for _, annotation := range annotations {
+		position := x(float64(annotation.Time - start))
+		fmt.Fprintf(&svg, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%.1f" stroke="#e24d42" stroke-dasharray="4,3" stroke-width="1.5"><title>%s</title></line>`,
+			position, chartTop, position, chartTop+plotHeight, template.HTMLEscapeString(annotation.Text))
+	}
+
+	if len(series) == 0 {
+		fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" text-anchor="middle">No activity</text>`, chartLeft+plotWidth/2, chartTop+plotHeight/2)
+	}
+	var legend []htmlLegend
+	for i, line := range series {
+		color := chartColors[i%len(chartColors)]
+		legend = append(legend, htmlLegend{Name: line.name, Color: color})
+		var points []string
+		for _, point := range line.points {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(point[0]), y(point[1])))
+		}
+		fmt.Fprintf(&svg, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="%s"><title>%s</title></polyline>`,
+			color, strings.Join(points, " "), template.HTMLEscapeString(line.name))
+	}
+	svg.WriteString(`</svg>`)
+
+	return htmlChart{Title: title, Svg: template.HTML(svg.String()), Legend: legend}
+}
+
+// Smallest 1, 2 or 5 times a power of ten above a value, to round the values axis
+func niceCeiling(value float64) float64 {
+	if value <= 0 {
+		return 1
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10(value)))
+	for _, step := range []float64{1, 2, 5, 10} {
+		if step*magnitude >= value {
+			return step * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+// Format a value of the values axis with binary prefixes, e.g. 1.5 MiB
+func formatChartValue(value float64, unit string) string {
+	if unit == "cores" {
+		return formatReportValue(value)
+	}
+	prefixes := []string{"", "Ki", "Mi", "Gi", "Ti", "Pi"}
+	i := 0
+	for value >= 1024 && i < len(prefixes)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%s %s%s", formatReportValue(math.Round(value*10)/10), prefixes[i], unit)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blackswifthosting/statexec/promfile"
+)
+
+// Path of the statexec dashboard provisioned by the explorer
+const dashboardPath = "/d/statexec/statexec-dashboard"
+
+// Destination of the imported metrics and annotations
+type importTarget struct {
+	vmUrl        string
+	grafanaUrl   string
+	grafanaToken string
+	client       *http.Client
+}
+
+func runImport(args []string) int {
+	if subcommandHelp("import", args) {
+		return 0
+	}
+	target := importTarget{
+		vmUrl:      "http://localhost:8428",
+		grafanaUrl: "http://localhost:3000",
+		client:     &http.Client{Timeout: 60 * time.Second},
+	}
+	var wait time.Duration
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--vm-url", "--grafana-url", "--grafana-token", "--wait":
+			if i+1 >= len(args) {
+				fmt.Println("Error: missing value for option", args[i])
+				return 1
+			}
+			i++
+			switch args[i-1] {
+			case "--vm-url":
+				target.vmUrl = strings.TrimRight(args[i], "/")
+			case "--grafana-url":
+				target.grafanaUrl = strings.TrimRight(args[i], "/")
+			case "--grafana-token":
+				target.grafanaToken = args[i]
+			case "--wait":
+				duration, err := parseDuration(args[i])
+				if err != nil {
+					fmt.Println("Error: invalid value for option --wait:", err)
+					return 1
+				}
+				wait = duration
+			}
+		default:
+			paths = append(paths, args[i])
+		}
+	}
+
+	paths, err := expandPromPaths(paths)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	files, ok := readPromFiles(paths)
+	if !ok {
+		return 1
+	}
+
+	if wait > 0 {
+		if err := target.waitReady(wait); err != nil {
+			fmt.Println("Error:", err)
+			return 1
+		}
+	}
+
+	var first, last int64
+	// Minimum interval of the panels of all runs: the largest one, so that
+	// rates of the slowest runs are not empty
+	var interval time.Duration
+	for i, file := range files {
+		if err := target.importMetrics(file); err != nil {
+			fmt.Printf("Error importing metrics of %s: %s\n", paths[i], err)
+			return 1
+		}
+		if err := target.importAnnotations(file); err != nil {
+			fmt.Printf("Error importing annotations of %s: %s\n", paths[i], err)
+			return 1
+		}
+
+		fileInterval, _ := time.ParseDuration(file.Header["Interval"])
+		interval = max(interval, fileInterval)
+		for _, run := range reportRuns(file) {
+			runFile := &promfile.File{}
+			for _, sample := range file.Samples {
+				if run.matches(sample) {
+					runFile.Samples = append(runFile.Samples, sample)
+				}
+			}
+			start, end := runFile.TimeRange()
+			fmt.Printf("View %s (%s) of %s: %s\n", run.instance, run.role, paths[i], target.dashboardUrl(start, end, fileInterval, &run))
+			if first == 0 || start < first {
+				first = start
+			}
+			if end > last {
+				last = end
+			}
+		}
+	}
+	if len(files) > 1 {
+		fmt.Printf("View all runs: %s\n", target.dashboardUrl(first, last, interval, nil))
+	}
+	return 0
+}
+
+// Replace directories by the metrics files they contain
+func expandPromPaths(paths []string) ([]string, error) {
+	var expanded []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			expanded = append(expanded, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() && strings.HasSuffix(path, ".prom") {
+				expanded = append(expanded, path)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+// Wait for VictoriaMetrics and Grafana to be up, e.g. right after the explorer started
+func (t *importTarget) waitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, health := range []string{t.vmUrl + "/health", t.grafanaUrl + "/api/health"} {
+		for {
+			response, err := t.client.Get(health)
+			if err == nil {
+				response.Body.Close()
+				if response.StatusCode == http.StatusOK {
+					break
+				}
+				err = fmt.Errorf("%s", response.Status)
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%s not ready after %s: %w", health, timeout, err)
+			}
+			time.Sleep(1 * time.Second)
+		}
+	}
+	return nil
+}
+
+// Send samples to the VictoriaMetrics prometheus import API, with their timestamps
+func (t *importTarget) importMetrics(file *promfile.File) error {
+	var body bytes.Buffer
+	for _, sample := range file.Samples {
+		body.WriteString(promfile.FormatSample(sample) + "\n")
+	}
+	return t.post(t.vmUrl+"/api/v1/import/prometheus", "text/plain", &body, "")
+}
+
+func (t *importTarget) importAnnotations(file *promfile.File) error {
+	for _, annotation := range file.Annotations {
+		annotationJson, err := json.Marshal(annotation)
+		if err != nil {
+			return err
+		}
+		err = t.post(t.grafanaUrl+"/api/annotations", "application/json", bytes.NewReader(annotationJson), t.grafanaToken)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *importTarget) post(endpoint string, contentType string, body io.Reader, token string) error {
+	request, err := http.NewRequest(http.MethodPost, endpoint, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := t.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s: %s", response.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// Dashboard URL on a time range, for a single run or all of them, with the
+// collection interval as the minimum interval of the panels when known.
+// Credentials of the Grafana URL are left out.
+func (t *importTarget) dashboardUrl(start int64, end int64, interval time.Duration, run *reportRun) string {
+	base, err := url.Parse(t.grafanaUrl + dashboardPath)
+	if err != nil {
+		return t.grafanaUrl + dashboardPath
+	}
+	base.User = nil
+	query := url.Values{}
+	query.Set("orgId", "1")
+	query.Set("from", fmt.Sprint(start))
+	// The last samples are still visible at the end of the range
+	query.Set("to", fmt.Sprint(end+1000))
+	if interval > 0 {
+		query.Set("var-interval", interval.String())
+	}
+	if run != nil {
+		query.Set("var-instance", run.instance)
+		query.Set("var-role", run.role)
+	}
+	base.RawQuery = query.Encode()
+	return base.String()
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blackswifthosting/statexec/runner"
+)
+
+// A command line option, with its SE_ environment variable equivalent
+type option struct {
+	names    []string // Flag names, the long one first, e.g. --file, -f
+	env      string   // Environment variable without prefix, empty if none
+	envAlias string   // Former environment variable still accepted, empty if none
+	arg      string   // Value placeholder, empty for switches
+	help     string
+	section  string
+	set      func(value string) error // Switches are set with "true" or "false"
+}
+
+const (
+	sectionCommon = "Common options"
+	sectionSync   = "Synchronization options"
+	sectionExport = "Export options"
+	sectionOther  = "Other options"
+)
+
+var (
+	// Print the resolved configuration instead of running the command
+	printConfig bool
+
+	// Options in the order of the usage
+	options []option
+)
+
+func init() {
+	allCollectors, _ := runner.CollectorNames("")
+	options = []option{
+		{names: []string{"--file", "-f"}, env: "FILE", arg: "<file>", section: sectionCommon,
+			help: "Metrics file, other formats replace its extension (default: statexec_metrics.prom)",
+			set:  func(value string) error { metricsFile = value; return nil }},
+		{names: []string{"--format"}, env: "FORMAT", arg: "<list>", section: sectionCommon,
+			help: "Comma separated output formats: " + strings.Join(outputFormatNames, ", ") + " (default: prom)",
+			set: func(value string) error {
+				var formats []string
+				for _, format := range strings.Split(value, ",") {
+					format = strings.TrimSpace(format)
+					if !slices.Contains(outputFormatNames, format) {
+						return fmt.Errorf("unknown format %q (available: %s)", format, strings.Join(outputFormatNames, ", "))
+					}
+					if !slices.Contains(formats, format) {
+						formats = append(formats, format)
+					}
+				}
+				outputFormats = formats
+				return nil
+			}},
+		{names: []string{"--trace-out"}, env: "TRACE_OUT", arg: "<file>", section: sectionCommon,
+			help: "Also write the timeline of the run in Chrome Trace Event format, for ui.perfetto.dev (no default)",
+			set:  func(value string) error { traceFile = value; return nil }},
+		{names: []string{"--summary-markdown"}, env: "SUMMARY_MARKDOWN", arg: "<file>", section: sectionCommon,
+			help: "Write a Markdown summary of the run, appended to $GITHUB_STEP_SUMMARY when set (no default)",
+			set:  func(value string) error { summaryMarkdownFile = value; return nil }},
+		{names: []string{"--instance", "-i"}, env: "INSTANCE", arg: "<instance>", section: sectionCommon,
+			help: "Instance name (default: <command>)",
+			set:  func(value string) error { runOptions.Instance = value; return nil }},
+		{names: []string{"--metrics-start-time", "-mst"}, env: "METRICS_START_TIME", arg: "<timestamp>", section: sectionCommon,
+			help: "Metrics start time, in milliseconds since epoch or RFC3339 (default: now)",
+			set: func(value string) (err error) {
+				runOptions.MetricsStartTime, err = parseTimestamp(value)
+				return err
+			}},
+		{names: []string{"--delay", "-d"}, env: "DELAY", arg: "<duration>", section: sectionCommon,
+			help: "Delay before and after the command, e.g. 5 (seconds) or 1m30s (default: 0)",
+			set: func(value string) error {
+				delay, err := parseDuration(value)
+				runOptions.DelayBeforeCommand, runOptions.DelayAfterCommand = delay, delay
+				return err
+			}},
+		{names: []string{"--delay-before-command", "-dbc"}, env: "DELAY_BEFORE_COMMAND", arg: "<duration>", section: sectionCommon,
+			help: "Delay before the command (default: 0)",
+			set:  durationSetter(&runOptions.DelayBeforeCommand)},
+		{names: []string{"--delay-after-command", "-dac"}, env: "DELAY_AFTER_COMMAND", arg: "<duration>", section: sectionCommon,
+			help: "Delay after the command (default: 0)",
+			set:  durationSetter(&runOptions.DelayAfterCommand)},
+		{names: []string{"--label", "-l"}, env: "LABEL_<key>", arg: "<key>=<value>", section: sectionCommon,
+			help: "Extra label to add to all metrics, can be repeated (no default)",
+			set: func(value string) error {
+				key, labelValue, found := strings.Cut(value, "=")
+				if !found {
+					return fmt.Errorf("expected <key>=<value>, found %q", value)
+				}
+				return addLabel(key, labelValue)
+			}},
+		{names: []string{"--interval"}, env: "INTERVAL", arg: "<duration>", section: sectionCommon,
+			help: "Interval between two metric collections, e.g. 100ms or 5s (default: 1s)",
+			set: func(value string) (err error) {
+				runOptions.Interval, err = parseInterval(value)
+				return err
+			}},
+		{names: []string{"--collectors"}, env: "COLLECTORS", arg: "<list>", section: sectionCommon,
+			help: "Collectors to enable, or disable with a - prefix (default: " + strings.Join(allCollectors, ",") + ")",
+			set: func(value string) error {
+				_, err := runner.CollectorNames(value)
+				runOptions.Collectors = value
+				return err
+			}},
+
+		{names: []string{"--server", "-s"}, env: "SERVER", section: sectionSync,
+			help: "Start server mode (default: false)",
+			set: func(value string) error {
+				enabled, err := strconv.ParseBool(value)
+				if err != nil || !enabled {
+					return err
+				}
+				return setRole("server")
+			}},
+		{names: []string{"--connect", "-c"}, env: "CONNECT", arg: "<ip>", section: sectionSync,
+			help: "Connect to server on <ip> (no default)",
+			set: func(value string) error {
+				serverIp = value
+				return setRole("client")
+			}},
+		{names: []string{"--sync-port", "-sp"}, env: "SYNC_PORT", arg: "<port>", section: sectionSync,
+			help: "Sync port (default: 8080)",
+			set: func(value string) error {
+				if port, err := strconv.Atoi(value); err != nil || port < 1 || port > 65535 {
+					return fmt.Errorf("invalid port %q", value)
+				}
+				syncPort = value
+				return nil
+			}},
+		{names: []string{"--sync-start-only", "-sso"}, env: "SYNC_START_ONLY", section: sectionSync,
+			help: "Only synchronize the start of the commands (default: false)",
+			set: func(value string) error {
+				startOnly, err := strconv.ParseBool(value)
+				syncWaitForStop = !startOnly
+				return err
+			}},
+		{names: []string{"--delay-before-sync", "-dbs"}, env: "DELAY_BEFORE_SYNC", envAlias: "SYNC_TIMEOUT", arg: "<duration>", section: sectionSync,
+			help: "Delay before the client syncs with the server (default: 0)",
+			set:  durationSetter(&delayBeforeSync)},
+		{names: []string{"--sync-until-succeed", "-sus"}, env: "SYNC_UNTIL_SUCCEED", section: sectionSync,
+			help: "Client retries to sync with the server until it succeeds (default: false)",
+			set:  boolSetter(&syncUntilSucceed)},
+
+		{names: []string{"--remote-write-url"}, env: "REMOTE_WRITE_URL", arg: "<url>", section: sectionExport,
+			help: "Push the metrics to a Prometheus remote write endpoint while running (no default)",
+			set:  func(value string) error { remoteWrite.url = value; return nil }},
+		{names: []string{"--remote-write-username"}, env: "REMOTE_WRITE_USERNAME", arg: "<username>", section: sectionExport,
+			help: "Basic authentication username of the remote write endpoint (no default)",
+			set:  func(value string) error { remoteWrite.username = value; return nil }},
+		{names: []string{"--remote-write-password"}, env: "REMOTE_WRITE_PASSWORD", arg: "<password>", section: sectionExport,
+			help: "Basic authentication password of the remote write endpoint (no default)",
+			set:  func(value string) error { remoteWrite.password = value; return nil }},
+		{names: []string{"--remote-write-bearer-token"}, env: "REMOTE_WRITE_BEARER_TOKEN", arg: "<token>", section: sectionExport,
+			help: "Bearer token of the remote write endpoint, instead of basic authentication (no default)",
+			set:  func(value string) error { remoteWrite.bearerToken = value; return nil }},
+		{names: []string{"--influx-url"}, env: "INFLUX_URL", arg: "<url>", section: sectionExport,
+			help: "Push the line protocol file to the InfluxDB v2 write API at the end of the run, implies --format influx (no default)",
+			set:  func(value string) error { influx.url = value; return nil }},
+		{names: []string{"--influx-org"}, env: "INFLUX_ORG", arg: "<org>", section: sectionExport,
+			help: "InfluxDB organization (no default)",
+			set:  func(value string) error { influx.org = value; return nil }},
+		{names: []string{"--influx-bucket"}, env: "INFLUX_BUCKET", arg: "<bucket>", section: sectionExport,
+			help: "InfluxDB bucket (no default)",
+			set:  func(value string) error { influx.bucket = value; return nil }},
+		{names: []string{"--influx-token"}, env: "INFLUX_TOKEN", arg: "<token>", section: sectionExport,
+			help: "InfluxDB API token (no default)",
+			set:  func(value string) error { influx.token = value; return nil }},
+		{names: []string{"--otlp-endpoint"}, env: "OTLP_ENDPOINT", arg: "<url>", section: sectionExport,
+			help: "Export the metrics to an OpenTelemetry collector while running, and the annotations at the end of the run, e.g. http://localhost:4318 (no default)",
+			set:  func(value string) error { otlp.endpoint = value; return nil }},
+		{names: []string{"--otlp-protocol"}, env: "OTLP_PROTOCOL", arg: "<protocol>", section: sectionExport,
+			help: "OTLP protocol: http/protobuf or grpc (default: http/protobuf)",
+			set: func(value string) error {
+				if value != runner.OtlpProtocolHttp && value != runner.OtlpProtocolGrpc {
+					return fmt.Errorf("unknown protocol %q (available: %s, %s)", value, runner.OtlpProtocolHttp, runner.OtlpProtocolGrpc)
+				}
+				otlp.protocol = value
+				return nil
+			}},
+		{names: []string{"--otlp-header"}, env: "OTLP_HEADERS", arg: "<key>=<value>", section: sectionExport,
+			help: "Header sent to the OTLP endpoint, flag can be repeated, comma separated in the environment (no default)",
+			set: func(value string) error {
+				for _, header := range strings.Split(value, ",") {
+					key, headerValue, found := strings.Cut(header, "=")
+					if !found || strings.TrimSpace(key) == "" {
+						return fmt.Errorf("invalid header %q, expected <key>=<value>", header)
+					}
+					otlp.headers[strings.TrimSpace(key)] = strings.TrimSpace(headerValue)
+				}
+				return nil
+			}},
+		{names: []string{"--otlp-insecure"}, env: "OTLP_INSECURE", section: sectionExport,
+			help: "Connect to an OTLP endpoint given without scheme without TLS (default: false)",
+			set:  boolSetter(&otlp.insecure)},
+		{names: []string{"--command-timeout", "-cmdt"}, env: "COMMAND_TIMEOUT", arg: "<duration>", section: sectionOther,
+			help: "Stop the command after this duration, e.g. 90 or 1m30s (no default)",
+			set:  durationSetter(&runOptions.CommandTimeout)},
+		{names: []string{"--timeout-signal"}, env: "TIMEOUT_SIGNAL", arg: "<signal>", section: sectionOther,
+			help: "Signal sent to the command process group on timeout (default: TERM)",
+			set: func(value string) (err error) {
+				runOptions.TimeoutSignal, err = runner.ParseSignal(value)
+				return err
+			}},
+		{names: []string{"--kill-after"}, env: "KILL_AFTER", arg: "<duration>", section: sectionOther,
+			help: "Time given to the command to stop after the timeout signal before SIGKILL (default: 10s)",
+			set:  positiveDurationSetter(&runOptions.KillAfter)},
+		{names: []string{"--forward-signal"}, env: "FORWARD_SIGNAL", arg: "<signal>", section: sectionOther,
+			help: "Signal sent to the command when statexec receives SIGTERM, SIGHUP or SIGQUIT (default: the received signal)",
+			set: func(value string) (err error) {
+				runOptions.ForwardSignal, err = runner.ParseSignal(value)
+				return err
+			}},
+		{names: []string{"--grace-period"}, env: "GRACE_PERIOD", arg: "<duration>", section: sectionOther,
+			help: "Time given to the command to stop before it is killed (default: 10s)",
+			set:  positiveDurationSetter(&runOptions.GracePeriod)},
+		{names: []string{"--listen"}, env: "LISTEN", arg: "<address>", section: sectionOther,
+			help: "Serve the latest metrics on http://<address>/metrics while running, e.g. :9100 (no default, the sync server serves them in server mode)",
+			set: func(value string) error {
+				if _, _, err := net.SplitHostPort(value); err != nil {
+					return fmt.Errorf("invalid listen address %q", value)
+				}
+				listenAddress = value
+				return nil
+			}},
+		{names: []string{"--log-file", "-lf"}, env: "LOG_FILE", envAlias: "LOG_FILE_PATH", arg: "<file>", section: sectionOther,
+			help: "File receiving the stdout and stderr of the command (default: inherited)",
+			set:  func(value string) error { logFilePath = value; return nil }},
+		{names: []string{"--tui"}, env: "TUI", section: sectionOther,
+			help: "Show a live dashboard of the metrics and the command output in the terminal while running (default: false)",
+			set:  boolSetter(&tui)},
+		{names: []string{"--config"}, env: "CONFIG", arg: "<file>", section: sectionOther,
+			help: "YAML or TOML configuration file, overridden by environment variables and flags (no default)",
+			set:  func(value string) error { configPath = value; return nil }},
+		{names: []string{"--print-config"}, section: sectionOther,
+			help: "Print the resolved configuration as a configuration file and exit",
+			set:  boolSetter(&printConfig)},
+		{names: []string{"--version", "-v"}, section: sectionOther,
+			help: "Print version and exit",
+			set: func(string) error {
+				fmt.Println(version)
+				os.Exit(0)
+				return nil
+			}},
+		{names: []string{"--help", "-help", "-h"}, section: sectionOther,
+			help: "Print help and exit",
+			set: func(string) error {
+				usage()
+				os.Exit(0)
+				return nil
+			}},
+	}
+}
+
+func durationSetter(target *time.Duration) func(string) error {
+	return func(value string) (err error) {
+		*target, err = parseDuration(value)
+		return err
+	}
+}
+
+// Durations where 0 would mean the default of the runner
+func positiveDurationSetter(target *time.Duration) func(string) error {
+	return func(value string) error {
+		duration, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		if duration == 0 {
+			return fmt.Errorf("duration must be positive, found %s", value)
+		}
+		*target = duration
+		return nil
+	}
+}
+
+func boolSetter(target *bool) func(string) error {
+	return func(value string) (err error) {
+		*target, err = strconv.ParseBool(value)
+		return err
+	}
+}
+
+// Server and client roles are mutually exclusive
+func setRole(newRole string) error {
+	if role != "standalone" && role != newRole {
+		return fmt.Errorf("server and client modes are mutually exclusive")
+	}
+	role = newRole
+	return nil
+}
+
+func findOption(name string) *option {
+	for i := range options {
+		for _, optionName := range options[i].names {
+			if optionName == name {
+				return &options[i]
+			}
+		}
+	}
+	return nil
+}
+
+func usage() {
+	binself := os.Args[0]
+	fmt.Printf("Usage: %s [OPTIONS] <command> [command args]\n", binself)
+	for _, subcommand := range subcommands {
+		fmt.Printf("       %s %s %s\n", binself, subcommand.name, subcommand.args)
+	}
+	fmt.Printf("Version: %s\n", version)
+
+	fmt.Printf("\nSubcommands:\n")
+	for _, subcommand := range subcommands {
+		fmt.Printf("  %-10s %s\n", subcommand.name, subcommand.help)
+	}
+	fmt.Println("Without subcommand, the command runs in the mode selected by the options.")
+
+	section := ""
+	for _, opt := range options {
+		if opt.section != section {
+			section = opt.section
+			fmt.Printf("\n%s:\n", section)
+		}
+		flags := strings.Join(opt.names, ", ")
+		if opt.arg != "" {
+			flags += " " + opt.arg
+		}
+		env := ""
+		if opt.env != "" {
+			env = EnvVarPrefix + opt.env
+		}
+		fmt.Printf("  %-42s %-26s %s\n", flags, env, opt.help)
+	}
+	fmt.Printf("  %-42s %-26s %s\n", "--", "", "Stop parsing options, the command follows")
+
+	fmt.Println("")
+	fmt.Println("Durations are Go durations (100ms, 1m30s) or a number of seconds.")
+	fmt.Println("")
+	fmt.Println("Standalone examples:")
+	fmt.Printf("  %s ping 8.8.8.8 -c 4\n", binself)
+	fmt.Printf("  %sFILE=data.prom %sLABEL_type=sample %s -d 3 -l env=dev -- ./mycommand.sh arg1 arg2\n", EnvVarPrefix, EnvVarPrefix, binself)
+	fmt.Println("")
+	fmt.Println("Sync mode examples:")
+	fmt.Println("  # Wait for a client sync to start the command")
+	fmt.Printf("  %s serve -- date\n", binself)
+	fmt.Println("  # Connect to server on <localhost> to start and stop the command")
+	fmt.Printf("  %s connect localhost -- echo start date now\n", binself)
+	fmt.Println("")
+	fmt.Println("Offline examples:")
+	fmt.Printf("  %s merge -o all.prom server.prom client.prom\n", binself)
+	fmt.Printf("  %s report all.prom\n", binself)
+}
+
+// Parse options until the command, and return the command with its arguments
+func parseArgs(args []string) ([]string, error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return args[i+1:], nil
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return args[i:], nil
+		}
+
+		// Long options also accept --name=value
+		name, value, hasValue := arg, "", false
+		if strings.HasPrefix(arg, "--") {
+			name, value, hasValue = strings.Cut(arg, "=")
+		}
+		opt := findOption(name)
+		if opt == nil {
+			return nil, fmt.Errorf("unknown option %s, use -- before a command starting with a dash", name)
+		}
+
+		switch {
+		case opt.arg == "" && hasValue:
+			return nil, fmt.Errorf("option %s does not take a value", name)
+		case opt.arg == "":
+			value = "true"
+		case !hasValue:
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing value for option %s %s", name, opt.arg)
+			}
+			i++
+			value = args[i]
+		}
+
+		if err := opt.set(value); err != nil {
+			return nil, fmt.Errorf("invalid value for option %s: %w", name, err)
+		}
+	}
+	return nil, nil
+}
+
+// Apply SE_ environment variables, before command line options
+func parseEnvVars() error {
+	for _, opt := range options {
+		if opt.env == "" || strings.Contains(opt.env, "<") {
+			continue
+		}
+		envName := EnvVarPrefix + opt.env
+		value, found := os.LookupEnv(envName)
+		if !found && opt.envAlias != "" {
+			envName = EnvVarPrefix + opt.envAlias
+			value, found = os.LookupEnv(envName)
+		}
+		if !found || value == "" {
+			continue
+		}
+		if err := opt.set(value); err != nil {
+			return fmt.Errorf("invalid value for %s env var: %w", envName, err)
+		}
+	}
+
+	// Extra labels (-l, --label)
+	for _, env := range os.Environ() {
+		if key, value, found := strings.Cut(env, "="); found && strings.HasPrefix(key, EnvVarPrefix+"LABEL_") {
+			if err := addLabel(strings.TrimPrefix(key, EnvVarPrefix+"LABEL_"), value); err != nil {
+				return fmt.Errorf("invalid value for %s env var: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Parse a Go duration (100ms, 5s...), a bare integer is a number of seconds
+func parseDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, intErr := strconv.ParseInt(value, 10, 64)
+		if intErr != nil {
+			return 0, err
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("duration must not be negative, found %s", value)
+	}
+	return duration, nil
+}
+
+// Parse a collection interval, see parseDuration
+func parseInterval(value string) (time.Duration, error) {
+	interval, err := parseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if interval < time.Millisecond {
+		return 0, fmt.Errorf("interval must be at least 1ms, found %s", value)
+	}
+	return interval, nil
+}
+
+// Parse a timestamp in milliseconds since epoch, or a RFC3339 date
+func parseTimestamp(value string) (int64, error) {
+	milliseconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		date, dateErr := time.Parse(time.RFC3339, value)
+		if dateErr != nil {
+			return 0, fmt.Errorf("expected milliseconds since epoch or a RFC3339 date, found %q", value)
+		}
+		milliseconds = date.UnixMilli()
+	}
+	// The runner uses the real start time for 0
+	if milliseconds <= 0 {
+		return 0, fmt.Errorf("timestamp must be after the epoch, found %q", value)
+	}
+	return milliseconds, nil
+}
+
+func addLabel(key string, value string) error {
+	// Labels set by statexec or its collectors, and labels of the run
+	// metadata and annotations in metrics files
+	forbiddenKeys := []string{"instance", "job", "role", "cpu", "mode", "interface", "disk", "type",
+		"collector", "version", "url", "interval", "merged", "config", "text", "tags"}
+
+	// Replace non-alphanumeric characters with underscores
+	safeKey := strings.ToLower(regexp.MustCompile(`[^a-zA-Z0-9]`).ReplaceAllString(key, "_"))
+
+	for _, forbiddenKey := range forbiddenKeys {
+		if safeKey == forbiddenKey {
+			return fmt.Errorf("label %s is forbidden", key)
+		}
+	}
+
+	runOptions.Labels[safeKey] = value
+	return nil
+}
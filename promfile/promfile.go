@@ -0,0 +1,749 @@
+// Package promfile reads and writes the metrics files produced by statexec.
+//
+// Complete files are OpenMetrics text: families are grouped, timestamps are
+// in seconds, the run metadata is the statexec_run info family, annotations
+// are the statexec_annotation family, and the file ends with # EOF.
+//
+// While the command runs, or if statexec was killed, the file is streamed in
+// prometheus text instead: samples of every collection with timestamps in
+// milliseconds, header comments and #grafana-annotation lines. Both layouts
+// are read the same way.
+package promfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MetricPrefix     = "statexec_"
+	SummaryPrefix    = MetricPrefix + "summary_"
+	annotationPrefix = "#grafana-annotation "
+	eofMarker        = "# EOF"
+
+	// OpenMetrics families holding the run metadata and the annotations
+	runFamily        = MetricPrefix + "run"
+	annotationFamily = MetricPrefix + "annotation"
+)
+
+// Header comments, stored as labels of the statexec_run info sample
+var headerKeys = []string{"Collector", "Version", "Url", "Interval", "Merged"}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Name      string
+	Labels    []Label // In file order
+	Value     float64
+	Timestamp int64 // In milliseconds
+}
+
+// Value of a label, empty if the sample does not have it
+func (s Sample) Label(name string) string {
+	for _, label := range s.Labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// Identifier of the series of a sample, its name and labels
+func (s Sample) SeriesKey() string {
+	var builder strings.Builder
+	builder.WriteString(s.Name)
+	for _, label := range s.Labels {
+		builder.WriteString("," + label.Name + "=" + label.Value)
+	}
+	return builder.String()
+}
+
+type Family struct {
+	Name string // As declared, counters end with _total in streamed files only
+	Help string
+	Type string
+	Unit string
+}
+
+// Name of the family in OpenMetrics, without the _total suffix of counters
+func (f Family) OpenMetricsName() string {
+	if f.Type == "counter" {
+		return strings.TrimSuffix(f.Name, "_total")
+	}
+	return f.Name
+}
+
+type Annotation struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd"`
+	Text    string   `json:"text"`
+	Tags    []string `json:"tags"`
+}
+
+// Value of a key=value tag, empty if the annotation does not have it
+func (a Annotation) Tag(key string) string {
+	for _, tag := range a.Tags {
+		if value, found := strings.CutPrefix(tag, key+"="); found {
+			return value
+		}
+	}
+	return ""
+}
+
+type File struct {
+	Header      map[string]string // Header comments such as Version or Interval
+	Config      string            // Resolved configuration of the run, if any
+	Families    []Family          // In declaration order
+	Samples     []Sample          // In file order, summary samples included
+	Annotations []Annotation
+	Complete    bool // The file ends with # EOF, statexec was not killed
+}
+
+// Family of a sample, nil if it was not declared
+func (f *File) FamilyOf(sampleName string) *Family {
+	for i, family := range f.Families {
+		if family.Name == sampleName || (family.Type == "counter" && family.OpenMetricsName()+"_total" == sampleName) {
+			return &f.Families[i]
+		}
+	}
+	return nil
+}
+
+// A line which could not be parsed
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Read and parse a metrics file
+func ReadFile(path string) (*File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	parsed, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return parsed, nil
+}
+
+// Parse a metrics file, stopping at the first invalid line
+func Parse(reader io.Reader) (*File, error) {
+	parser := newParser()
+	file := parser.file
+	// Timestamps are only known to be in seconds once # EOF is read
+	var timestamps []float64
+
+	scanner := newScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		sample, timestamp, err := parser.parseLine(scanner.Text())
+		if err != nil {
+			return nil, &ParseError{lineNumber, err}
+		}
+		if sample != nil {
+			file.Samples = append(file.Samples, *sample)
+			timestamps = append(timestamps, timestamp)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, timestamp := range timestamps {
+		file.Samples[i].Timestamp = file.milliseconds(timestamp)
+	}
+	parser.finish()
+	return file, nil
+}
+
+// Scanner of the lines of a metrics file, configurations may be long
+func newScanner(reader io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return scanner
+}
+
+// Line by line parser of a metrics file: header comments, families, run
+// metadata and annotations are stored in the file, samples are returned
+type parser struct {
+	file     *File
+	families map[string]int
+	inConfig bool
+	// Timestamps of statexec_annotation samples, -1 for #grafana-annotation lines
+	annotationTimestamps []float64
+}
+
+func newParser() *parser {
+	return &parser{
+		file:     &File{Header: make(map[string]string)},
+		families: make(map[string]int),
+	}
+}
+
+// Parse a line, and return the sample it holds, if any, with its timestamp
+// as is: its unit depends on the layout of the file
+func (p *parser) parseLine(line string) (*Sample, float64, error) {
+	file := p.file
+	if file.Complete {
+		if strings.TrimSpace(line) != "" {
+			return nil, 0, fmt.Errorf("unexpected content after %s", eofMarker)
+		}
+		return nil, 0, nil
+	}
+	if strings.TrimSpace(line) == "" {
+		p.inConfig = false
+		return nil, 0, nil
+	}
+	if line == eofMarker {
+		file.Complete = true
+		return nil, 0, nil
+	}
+
+	if annotation, found := strings.CutPrefix(line, annotationPrefix); found {
+		var parsed Annotation
+		if err := json.Unmarshal([]byte(annotation), &parsed); err != nil {
+			return nil, 0, fmt.Errorf("invalid annotation: %w", err)
+		}
+		file.Annotations = append(file.Annotations, parsed)
+		p.annotationTimestamps = append(p.annotationTimestamps, -1)
+		return nil, 0, nil
+	}
+
+	if comment, found := strings.CutPrefix(line, "#"); found {
+		comment = strings.TrimPrefix(comment, " ")
+		fields := strings.SplitN(comment, " ", 3)
+		switch {
+		case p.inConfig && strings.HasPrefix(comment, "  "):
+			file.Config += comment[2:] + "\n"
+		case len(fields) >= 2 && (fields[0] == "HELP" || fields[0] == "TYPE" || fields[0] == "UNIT"):
+			if fields[1] == runFamily || fields[1] == annotationFamily {
+				return nil, 0, nil
+			}
+			index, ok := p.families[fields[1]]
+			if !ok {
+				index = len(file.Families)
+				p.families[fields[1]] = index
+				file.Families = append(file.Families, Family{Name: fields[1]})
+			}
+			if len(fields) == 3 {
+				switch fields[0] {
+				case "HELP":
+					file.Families[index].Help = unescape(fields[2])
+				case "TYPE":
+					file.Families[index].Type = fields[2]
+				case "UNIT":
+					file.Families[index].Unit = fields[2]
+				}
+			}
+		case comment == "Config:":
+			p.inConfig = true
+		default:
+			// Header comments are "Key: value", other comments are ignored
+			if key, value, found := strings.Cut(comment, ": "); found && len(file.Families) == 0 && !strings.Contains(key, " ") {
+				file.Header[key] = value
+			}
+		}
+		return nil, 0, nil
+	}
+
+	sample, timestamp, err := parseSample(line)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch sample.Name {
+	case runFamily + "_info":
+		file.readRunInfo(sample)
+	case annotationFamily:
+		file.Annotations = append(file.Annotations, annotationOf(sample))
+		p.annotationTimestamps = append(p.annotationTimestamps, timestamp)
+	default:
+		return &sample, timestamp, nil
+	}
+	return nil, 0, nil
+}
+
+// Set the time of annotation samples, once the layout of the file is known
+func (p *parser) finish() {
+	for i, timestamp := range p.annotationTimestamps {
+		if timestamp >= 0 {
+			annotation := &p.file.Annotations[i]
+			duration := annotation.TimeEnd
+			annotation.Time = p.file.milliseconds(timestamp)
+			annotation.TimeEnd = annotation.Time + duration
+		}
+	}
+}
+
+// Timestamp in milliseconds, OpenMetrics timestamps are in seconds
+func (f *File) milliseconds(timestamp float64) int64 {
+	if f.Complete {
+		return int64(math.Round(timestamp * 1000))
+	}
+	return int64(timestamp)
+}
+
+// Header and configuration from a statexec_run info sample, the first run
+// of merged files wins
+func (f *File) readRunInfo(sample Sample) {
+	for _, key := range headerKeys {
+		if value := sample.Label(strings.ToLower(key)); value != "" {
+			if _, ok := f.Header[key]; !ok {
+				f.Header[key] = value
+			}
+		}
+	}
+	if f.Config == "" {
+		f.Config = sample.Label("config")
+	}
+}
+
+// Annotation from a statexec_annotation sample: other labels than text and
+// tags are key=value tags, the value is the duration in seconds. TimeEnd
+// holds the duration until the timestamp is known.
+func annotationOf(sample Sample) Annotation {
+	annotation := Annotation{
+		Text:    sample.Label("text"),
+		TimeEnd: int64(math.Round(sample.Value * 1000)),
+	}
+	for _, tag := range strings.Split(sample.Label("tags"), ",") {
+		if tag != "" {
+			annotation.Tags = append(annotation.Tags, tag)
+		}
+	}
+	for _, label := range sample.Labels {
+		if label.Name != "text" && label.Name != "tags" {
+			annotation.Tags = append(annotation.Tags, label.Name+"="+label.Value)
+		}
+	}
+	return annotation
+}
+
+// Parse a sample line: name{label="value",...} value timestamp. The
+// timestamp is returned as is, its unit depends on the layout of the file.
+func parseSample(line string) (Sample, float64, error) {
+	var sample Sample
+	rest := line
+
+	end := strings.IndexAny(rest, "{ ")
+	if end <= 0 {
+		return sample, 0, fmt.Errorf("invalid sample %q", line)
+	}
+	sample.Name = rest[:end]
+	rest = rest[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		labels, remaining, err := parseLabels(rest[1:])
+		if err != nil {
+			return sample, 0, fmt.Errorf("invalid labels in %q: %w", line, err)
+		}
+		sample.Labels = labels
+		rest = remaining
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) != 2 {
+		return sample, 0, fmt.Errorf("expected a value and a timestamp in %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return sample, 0, fmt.Errorf("invalid value in %q", line)
+	}
+	timestamp, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return sample, 0, fmt.Errorf("invalid timestamp in %q", line)
+	}
+	sample.Value = value
+	return sample, timestamp, nil
+}
+
+// Parse labels up to the closing brace, and return the rest of the line
+func parseLabels(text string) ([]Label, string, error) {
+	var labels []Label
+	for {
+		text = strings.TrimLeft(text, " ,")
+		if strings.HasPrefix(text, "}") {
+			return labels, text[1:], nil
+		}
+		name, rest, found := strings.Cut(text, "=\"")
+		if !found || name == "" {
+			return nil, "", fmt.Errorf("expected name=\"value\"")
+		}
+
+		var value strings.Builder
+		closed := false
+		for i := 0; i < len(rest); i++ {
+			switch rest[i] {
+			case '\\':
+				if i+1 >= len(rest) {
+					return nil, "", fmt.Errorf("unterminated escape")
+				}
+				i++
+				switch rest[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(rest[i])
+				}
+			case '"':
+				closed = true
+				text = rest[i+1:]
+			default:
+				value.WriteByte(rest[i])
+			}
+			if closed {
+				break
+			}
+		}
+		if !closed {
+			return nil, "", fmt.Errorf("unterminated value of label %s", name)
+		}
+		labels = append(labels, Label{Name: strings.TrimSpace(name), Value: value.String()})
+	}
+}
+
+// Summary samples, computed by statexec over the command execution
+func (f *File) Summary() []Sample {
+	var summary []Sample
+	for _, sample := range f.Samples {
+		if strings.HasPrefix(sample.Name, SummaryPrefix) {
+			summary = append(summary, sample)
+		}
+	}
+	return summary
+}
+
+// Samples of a metric family, without the statexec_ prefix
+func (f *File) Series(name string) []Sample {
+	var series []Sample
+	for _, sample := range f.Samples {
+		if sample.Name == MetricPrefix+name {
+			series = append(series, sample)
+		}
+	}
+	return series
+}
+
+// Values of a label over all samples, sorted
+func (f *File) LabelValues(name string) []string {
+	seen := make(map[string]bool)
+	var values []string
+	for _, sample := range f.Samples {
+		if value := sample.Label(name); value != "" && !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// First and last sample timestamps, in milliseconds
+func (f *File) TimeRange() (int64, int64) {
+	var first, last int64
+	for i, sample := range f.Samples {
+		if i == 0 || sample.Timestamp < first {
+			first = sample.Timestamp
+		}
+		if sample.Timestamp > last {
+			last = sample.Timestamp
+		}
+	}
+	return first, last
+}
+
+// Render a sample line
+func FormatSample(sample Sample) string {
+	var builder strings.Builder
+	builder.WriteString(sample.Name)
+	builder.WriteString("{")
+	for i, label := range sample.Labels {
+		if i > 0 {
+			builder.WriteString(",")
+		}
+		builder.WriteString(label.Name + "=\"" + EscapeLabelValue(label.Value) + "\"")
+	}
+	builder.WriteString("} ")
+	builder.WriteString(strconv.FormatFloat(sample.Value, 'f', -1, 64))
+	builder.WriteString(" " + strconv.FormatInt(sample.Timestamp, 10))
+	return builder.String()
+}
+
+// Escape backslashes, double quotes and line feeds of a label value
+func EscapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Unescape backslashes, double quotes and line feeds of a HELP text
+func unescape(text string) string {
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n").Replace(text)
+}
+
+// Unit of a family from the suffix of its name, empty if it has none
+func unitOf(name string) string {
+	for _, unit := range []string{"seconds", "bytes"} {
+		if strings.HasSuffix(name, "_"+unit) {
+			return unit
+		}
+	}
+	return ""
+}
+
+// Render a sample line in OpenMetrics, with a timestamp in seconds
+func formatOpenMetricsSample(sample Sample) string {
+	var builder strings.Builder
+	builder.WriteString(sample.Name)
+	if len(sample.Labels) > 0 {
+		builder.WriteString("{")
+		for i, label := range sample.Labels {
+			if i > 0 {
+				builder.WriteString(",")
+			}
+			builder.WriteString(label.Name + "=\"" + EscapeLabelValue(label.Value) + "\"")
+		}
+		builder.WriteString("}")
+	}
+	builder.WriteString(" " + strconv.FormatFloat(sample.Value, 'f', -1, 64))
+	builder.WriteString(" " + strconv.FormatFloat(float64(sample.Timestamp)/1000, 'f', 3, 64))
+	return builder.String()
+}
+
+// Samples grouped by series in first seen order, each series in time order
+func groupSeries(samples []Sample) []Sample {
+	var order []string
+	series := make(map[string][]Sample)
+	for _, sample := range samples {
+		key := sample.SeriesKey()
+		if _, ok := series[key]; !ok {
+			order = append(order, key)
+		}
+		series[key] = append(series[key], sample)
+	}
+	grouped := make([]Sample, 0, len(samples))
+	for _, key := range order {
+		sort.SliceStable(series[key], func(i, j int) bool {
+			return series[key][i].Timestamp < series[key][j].Timestamp
+		})
+		grouped = append(grouped, series[key]...)
+	}
+	return grouped
+}
+
+// Labels and start of every run: the series of statexec_command_status
+func (f *File) runs() []Sample {
+	var runs runList
+	for _, sample := range f.Samples {
+		runs.add(sample)
+	}
+	return runs.list()
+}
+
+// Runs of a file, gathered sample by sample
+type runList struct {
+	runs  []Sample
+	index map[string]int
+	first int64 // First timestamp of all samples, the run of files without status
+	seen  bool
+}
+
+func (r *runList) add(sample Sample) {
+	if !r.seen || sample.Timestamp < r.first {
+		r.first = sample.Timestamp
+	}
+	r.seen = true
+	if sample.Name != MetricPrefix+"command_status" {
+		return
+	}
+	key := sample.SeriesKey()
+	if i, ok := r.index[key]; ok {
+		r.runs[i].Timestamp = min(r.runs[i].Timestamp, sample.Timestamp)
+		return
+	}
+	if r.index == nil {
+		r.index = make(map[string]int)
+	}
+	r.index[key] = len(r.runs)
+	r.runs = append(r.runs, sample)
+}
+
+func (r *runList) list() []Sample {
+	if len(r.runs) == 0 && r.seen {
+		return []Sample{{Timestamp: r.first}}
+	}
+	return r.runs
+}
+
+// Error when a label name is used twice in a sample, which OpenMetrics forbids
+func checkLabelNames(sample Sample) error {
+	seen := make(map[string]bool, len(sample.Labels))
+	for _, label := range sample.Labels {
+		if seen[label.Name] {
+			return fmt.Errorf("label %s is used twice in a sample of %s", label.Name, sample.Name)
+		}
+		seen[label.Name] = true
+	}
+	return nil
+}
+
+// Write a metrics file in OpenMetrics text: the run metadata, metric
+// families with their samples grouped by series, annotations, then # EOF
+func (f *File) Write(writer io.Writer) error {
+	infos := f.runInfos(f.runs())
+	annotations := f.annotationSamples()
+	// Label names must be unique in a sample, e.g. extra labels of a run
+	// must not be named after its metadata
+	for _, samples := range [][]Sample{infos, annotations, f.Samples} {
+		for _, sample := range samples {
+			if err := checkLabelNames(sample); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Metric families in declaration order, then undeclared ones
+	order, families := f.openMetricsFamilies()
+	samples := make(map[string][]Sample)
+	for _, sample := range f.Samples {
+		name := f.openMetricsFamilyOf(sample.Name)
+		if _, ok := families[name]; !ok {
+			families[name] = Family{Name: name, Type: "unknown"}
+			order = append(order, name)
+		}
+		samples[name] = append(samples[name], sample)
+	}
+
+	buffered := bufio.NewWriter(writer)
+	writeSamples := func(samples []Sample) {
+		for _, sample := range samples {
+			fmt.Fprintln(buffered, formatOpenMetricsSample(sample))
+		}
+	}
+	writeFamilyDesc(buffered, runDesc)
+	writeSamples(infos)
+	for _, name := range order {
+		writeFamilyDesc(buffered, families[name])
+		writeSamples(groupSeries(samples[name]))
+	}
+	writeFamilyDesc(buffered, annotationDesc)
+	writeSamples(annotations)
+	fmt.Fprintln(buffered, eofMarker)
+	return buffered.Flush()
+}
+
+var (
+	runDesc = Family{
+		Name: runFamily,
+		Type: "info",
+		Help: "Run of a command: version of statexec, collection interval and resolved configuration",
+	}
+	annotationDesc = Family{
+		Name: annotationFamily,
+		Type: "unknown",
+		Help: "Events of the run, as Grafana annotations: the value is the duration in seconds",
+	}
+)
+
+// Write the TYPE, UNIT and HELP comments of a family
+func writeFamilyDesc(writer io.Writer, family Family) {
+	fmt.Fprintf(writer, "# TYPE %s %s\n", family.Name, family.Type)
+	if family.Unit != "" {
+		fmt.Fprintf(writer, "# UNIT %s %s\n", family.Name, family.Unit)
+	}
+	if family.Help != "" {
+		fmt.Fprintf(writer, "# HELP %s %s\n", family.Name, EscapeLabelValue(family.Help))
+	}
+}
+
+// Run metadata, an info sample per run
+func (f *File) runInfos(runs []Sample) []Sample {
+	var infos []Sample
+	for _, run := range runs {
+		labels := append([]Label{}, run.Labels...)
+		for _, key := range headerKeys {
+			if value := f.Header[key]; value != "" {
+				labels = append(labels, Label{Name: strings.ToLower(key), Value: value})
+			}
+		}
+		if f.Config != "" {
+			labels = append(labels, Label{Name: "config", Value: f.Config})
+		}
+		infos = append(infos, Sample{Name: runFamily + "_info", Labels: labels, Value: 1, Timestamp: run.Timestamp})
+	}
+	return infos
+}
+
+// Annotations as samples, key=value tags are labels
+func (f *File) annotationSamples() []Sample {
+	var annotations []Sample
+	for _, annotation := range f.Annotations {
+		var labels []Label
+		var kinds []string
+		for _, tag := range annotation.Tags {
+			if key, value, found := strings.Cut(tag, "="); found {
+				labels = append(labels, Label{Name: key, Value: value})
+			} else {
+				kinds = append(kinds, tag)
+			}
+		}
+		labels = append(labels, Label{Name: "text", Value: annotation.Text}, Label{Name: "tags", Value: strings.Join(kinds, ",")})
+		annotations = append(annotations, Sample{
+			Name:      annotationFamily,
+			Labels:    labels,
+			Value:     float64(annotation.TimeEnd-annotation.Time) / 1000,
+			Timestamp: annotation.Time,
+		})
+	}
+	return annotations
+}
+
+// Declared families by OpenMetrics name, in declaration order, with the
+// default type and unit
+func (f *File) openMetricsFamilies() ([]string, map[string]Family) {
+	var order []string
+	families := make(map[string]Family)
+	for _, family := range f.Families {
+		name := family.OpenMetricsName()
+		if _, ok := families[name]; ok {
+			continue
+		}
+		family.Name = name
+		if family.Type == "" {
+			family.Type = "unknown"
+		}
+		if family.Unit == "" {
+			family.Unit = unitOf(name)
+		}
+		families[name] = family
+		order = append(order, name)
+	}
+	return order, families
+}
+
+// OpenMetrics name of the family of a sample, its own name if undeclared
+func (f *File) openMetricsFamilyOf(sampleName string) string {
+	if family := f.FamilyOf(sampleName); family != nil {
+		return family.OpenMetricsName()
+	}
+	return sampleName
+}
@@ -0,0 +1,161 @@
+package promfile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Size of the sample lines kept in memory before they are appended to the
+// files of their series
+const spoolSize = 1024 * 1024
+
+// Series spooled to its own file while a streamed file is rewritten
+type spooledSeries struct {
+	path    string
+	pending []byte
+}
+
+// Rewrite a streamed metrics file in OpenMetrics, as Parse then Write would,
+// without holding its samples in memory: in a single pass, the samples of
+// every series are spooled to a file in directory spool, then the files are
+// concatenated family by family. Series are expected in time order, as
+// streamed by statexec.
+func Rewrite(reader io.Reader, writer io.Writer, spool string) error {
+	parser := newParser()
+	file := parser.file
+	var runs runList
+	var seenFamilies []string
+	familySeries := make(map[string][]*spooledSeries)
+	series := make(map[string]*spooledSeries)
+	familyOf := make(map[string]string)
+	pending := 0
+
+	spoolPending := func() error {
+		for _, spooled := range series {
+			if len(spooled.pending) == 0 {
+				continue
+			}
+			output, err := os.OpenFile(spooled.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+			if err != nil {
+				return err
+			}
+			_, err = output.Write(spooled.pending)
+			if closeErr := output.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+			spooled.pending = spooled.pending[:0]
+		}
+		pending = 0
+		return nil
+	}
+
+	scanner := newScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		sample, timestamp, err := parser.parseLine(scanner.Text())
+		if err != nil {
+			return &ParseError{lineNumber, err}
+		}
+		if file.Complete {
+			return errors.New("the file is already in OpenMetrics")
+		}
+		if sample == nil {
+			continue
+		}
+		sample.Timestamp = file.milliseconds(timestamp)
+		if err := checkLabelNames(*sample); err != nil {
+			return err
+		}
+		runs.add(*sample)
+
+		key := sample.SeriesKey()
+		spooled, ok := series[key]
+		if !ok {
+			// Families are all declared in the header, before any sample
+			family, ok := familyOf[sample.Name]
+			if !ok {
+				family = file.openMetricsFamilyOf(sample.Name)
+				familyOf[sample.Name] = family
+			}
+			if _, ok := familySeries[family]; !ok {
+				seenFamilies = append(seenFamilies, family)
+			}
+			spooled = &spooledSeries{path: filepath.Join(spool, strconv.Itoa(len(series)))}
+			series[key] = spooled
+			familySeries[family] = append(familySeries[family], spooled)
+		}
+		line := formatOpenMetricsSample(*sample) + "\n"
+		spooled.pending = append(spooled.pending, line...)
+		pending += len(line)
+		if pending >= spoolSize {
+			if err := spoolPending(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := spoolPending(); err != nil {
+		return err
+	}
+	parser.finish()
+
+	infos := file.runInfos(runs.list())
+	annotations := file.annotationSamples()
+	for _, samples := range [][]Sample{infos, annotations} {
+		for _, sample := range samples {
+			if err := checkLabelNames(sample); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Metric families in declaration order, then undeclared ones
+	order, families := file.openMetricsFamilies()
+	for _, name := range seenFamilies {
+		if _, ok := families[name]; !ok {
+			families[name] = Family{Name: name, Type: "unknown"}
+			order = append(order, name)
+		}
+	}
+
+	buffered := bufio.NewWriter(writer)
+	writeFamilyDesc(buffered, runDesc)
+	for _, info := range infos {
+		fmt.Fprintln(buffered, formatOpenMetricsSample(info))
+	}
+	for _, name := range order {
+		writeFamilyDesc(buffered, families[name])
+		for _, spooled := range familySeries[name] {
+			if err := copyFile(buffered, spooled.path); err != nil {
+				return err
+			}
+		}
+	}
+	writeFamilyDesc(buffered, annotationDesc)
+	for _, annotation := range annotations {
+		fmt.Fprintln(buffered, formatOpenMetricsSample(annotation))
+	}
+	fmt.Fprintln(buffered, eofMarker)
+	return buffered.Flush()
+}
+
+func copyFile(writer io.Writer, path string) error {
+	input, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	_, err = io.Copy(writer, input)
+	return err
+}
@@ -0,0 +1,80 @@
+package promfile
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A streamed file rewritten through spooled series is the same as parsed
+// then written, including when the spool is flushed several times
+func TestRewriteMatchesWrite(t *testing.T) {
+	var streamed strings.Builder
+	streamed.WriteString(`
+# Collector: blackswift/statexec
+# Version: dev
+# Url: https://github.com/blackswifthosting/statexec/
+# Interval: 1s
+# Config:
+#   interval: 1s
+#   labels: {role: "server"}
+
+# HELP statexec_cpu_seconds_total Time spent by the cpus
+# TYPE statexec_cpu_seconds_total counter
+# HELP statexec_memory_used_bytes Used memory
+# TYPE statexec_memory_used_bytes gauge
+# HELP statexec_command_status Status of the command
+# TYPE statexec_command_status gauge
+
+`)
+	for second := int64(0); second < 2000; second++ {
+		timestamp := 1704067200000 + second*1000
+		for cpu := 0; cpu < 8; cpu++ {
+			for _, mode := range []string{"user", "system"} {
+				fmt.Fprintf(&streamed, "statexec_cpu_seconds_total{instance=\"host\",cpu=\"%d\",mode=\"%s\"} %d %d\n", cpu, mode, second*3, timestamp)
+			}
+		}
+		fmt.Fprintf(&streamed, "statexec_memory_used_bytes{instance=\"host\"} %d %d\n", 1000+second, timestamp)
+		fmt.Fprintf(&streamed, "statexec_undeclared{instance=\"host\"} 1.5 %d\n", timestamp)
+	}
+	streamed.WriteString(`
+#grafana-annotation {"time":1704067200000,"timeEnd":1704067201000,"text":"Command started","tags":["statexec","instance=host"]}
+
+# Result of the command
+statexec_command_status{instance="host"} 0 1704069200000
+`)
+
+	parsed, err := Parse(strings.NewReader(streamed.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected bytes.Buffer
+	if err := parsed.Write(&expected); err != nil {
+		t.Fatal(err)
+	}
+	var rewritten bytes.Buffer
+	if err := Rewrite(strings.NewReader(streamed.String()), &rewritten, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if rewritten.Len() < 2*spoolSize {
+		t.Fatalf("rewritten file of %d bytes, the spool is not flushed several times", rewritten.Len())
+	}
+	if rewritten.String() != expected.String() {
+		expectedLines := strings.Split(expected.String(), "\n")
+		for i, line := range strings.Split(rewritten.String(), "\n") {
+			if i >= len(expectedLines) || line != expectedLines[i] {
+				t.Fatalf("line %d is %q, expected %q", i+1, line, expectedLines[min(i, len(expectedLines)-1)])
+			}
+		}
+		t.Fatalf("rewritten file has %d bytes, expected %d", rewritten.Len(), expected.Len())
+	}
+}
+
+// Rewriting an OpenMetrics file fails, its timestamps are in seconds
+func TestRewriteRejectsCompleteFile(t *testing.T) {
+	complete := "# TYPE statexec_memory_used_bytes gauge\nstatexec_memory_used_bytes 1 1704067200.000\n# EOF\n"
+	if err := Rewrite(strings.NewReader(complete), &bytes.Buffer{}, t.TempDir()); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blackswifthosting/statexec/promfile"
+)
+
+func runReport(args []string) int {
+	if subcommandHelp("report", args) {
+		return 0
+	}
+	output := ""
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-o", "--output":
+			if i+1 >= len(args) {
+				fmt.Println("Error: missing value for option", args[i])
+				return 1
+			}
+			i++
+			output = args[i]
+		default:
+			paths = append(paths, args[i])
+		}
+	}
+
+	files, ok := readPromFiles(paths)
+	if !ok {
+		return 1
+	}
+	if output != "" {
+		if err := writeHtmlReport(output, paths, files); err != nil {
+			fmt.Println("Error writing report:", err)
+			return 1
+		}
+		return 0
+	}
+	for i, file := range files {
+		if i > 0 {
+			fmt.Println("")
+		}
+		fmt.Printf("== %s\n", paths[i])
+		printReport(file)
+	}
+	return 0
+}
+
+// A run of a metrics file, merged files hold several runs
+type reportRun struct {
+	instance string
+	role     string
+}
+
+func (r reportRun) matches(sample promfile.Sample) bool {
+	return sample.Label("instance") == r.instance && sample.Label("role") == r.role
+}
+
+func reportRuns(file *promfile.File) []reportRun {
+	var runs []reportRun
+	seen := make(map[reportRun]bool)
+	for _, sample := range file.Samples {
+		run := reportRun{instance: sample.Label("instance"), role: sample.Label("role")}
+		if !seen[run] {
+			seen[run] = true
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+// Format a timestamp in milliseconds
+func formatTimestamp(timestamp int64) string {
+	return time.UnixMilli(timestamp).UTC().Format(time.RFC3339Nano)
+}
+
+func printReport(file *promfile.File) {
+	fmt.Printf("statexec version: %s, interval: %s\n", file.Header["Version"], file.Header["Interval"])
+	if merged := file.Header["Merged"]; merged != "" {
+		fmt.Printf("merged from: %s\n", merged)
+	}
+
+	for _, run := range reportRuns(file) {
+		var samples, summary []promfile.Sample
+		for _, sample := range file.Samples {
+			if !run.matches(sample) {
+				continue
+			}
+			samples = append(samples, sample)
+			if strings.HasPrefix(sample.Name, promfile.SummaryPrefix) {
+				summary = append(summary, sample)
+			}
+		}
+		runFile := &promfile.File{Samples: samples}
+		start, end := runFile.TimeRange()
+
+		fmt.Println("")
+		fmt.Printf("Run of %s (%s)\n", run.instance, run.role)
+		fmt.Printf("  from %s to %s (%s)\n", formatTimestamp(start), formatTimestamp(end), time.Duration(end-start)*time.Millisecond)
+		if exitCodes := runFile.Series("command_exit_code"); len(exitCodes) > 0 {
+			fmt.Printf("  exit code: %v\n", exitCodes[0].Value)
+		}
+		if durations := runFile.Series("command_duration_seconds"); len(durations) > 0 {
+			fmt.Printf("  command duration: %vs\n", durations[0].Value)
+		}
+
+		var annotations []promfile.Annotation
+		for _, annotation := range file.Annotations {
+			if annotation.Tag("instance") == run.instance && annotation.Tag("role") == run.role {
+				annotations = append(annotations, annotation)
+			}
+		}
+		if len(annotations) > 0 {
+			fmt.Println("  Annotations:")
+			for _, annotation := range annotations {
+				offset := time.Duration(annotation.Time-start) * time.Millisecond
+				fmt.Printf("    +%-10s %s\n", offset, strings.ReplaceAll(annotation.Text, "\n", "\n                "))
+			}
+		}
+
+		if len(summary) > 0 {
+			fmt.Println("  Summary:")
+			for _, sample := range summary {
+				fmt.Printf("    %-60s %s\n", reportSampleName(sample), formatReportValue(sample.Value))
+			}
+		}
+	}
+}
+
+// Name of a summary sample with its own labels, without the run labels
+func reportSampleName(sample promfile.Sample) string {
+	name := strings.TrimPrefix(sample.Name, promfile.SummaryPrefix)
+	var labels []string
+	for _, label := range sample.Labels {
+		switch label.Name {
+		case "instance", "job", "role":
+		default:
+			labels = append(labels, label.Name+"="+label.Value)
+		}
+	}
+	if len(labels) > 0 {
+		name += "{" + strings.Join(labels, ",") + "}"
+	}
+	return name
+}
+
+func formatReportValue(value float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", value), "0"), ".")
+}
@@ -0,0 +1,399 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blackswifthosting/statexec/collectors"
+)
+
+// CsvWriter writes one wide row per collection, for spreadsheets: a column
+// per series, CPU summed over cores, and the per second rate of counters
+// since the previous row. Summary and result of the command go to a second
+// file, one row per value.
+//
+// Columns are those of the first collection with the command running, rows
+// collected before are written along with the header. Values of series
+// appearing later, e.g. a new network interface, go to a side file and are
+// merged into the file as extra columns once the run is over.
+type CsvWriter struct {
+	Version string // Version of statexec, written in the header
+
+	path        string
+	summaryPath string
+	file        *lineFile
+	info        RunInfo
+	counters    map[string]bool // Metric families of type counter
+	columns     []csvColumn     // Nil until the header is written
+	pending     []InstantMetric // Metrics collected before the header
+	previous    map[string]float64
+	previousTs  int64
+
+	rows      int         // Rows written after the header
+	late      []csvColumn // Series which appeared after the header
+	lateFile  *lineFile   // Value and rate of the late series for each row, from lateStart
+	lateStart int
+}
+
+type csvColumn struct {
+	name    string
+	key     string // Series key, see csvSeries
+	counter bool
+}
+
+// Write the metrics to path, and the summary to summaryPath
+func NewCsvWriter(path string, summaryPath string) *CsvWriter {
+	return &CsvWriter{Version: "dev", path: path, summaryPath: summaryPath}
+}
+
+func (w *CsvWriter) Start(info RunInfo) error {
+	file, err := createLineFile(w.path)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.info = info
+	w.counters = make(map[string]bool)
+	for _, desc := range info.Descs {
+		w.counters[desc.Name] = desc.Type == collectors.TypeCounter
+	}
+	w.columns = nil
+	w.pending = nil
+	w.previous = nil
+	w.rows = 0
+	w.late = nil
+	w.lateFile = nil
+	return nil
+}
+
+// Side file of the late series
+func (w *CsvWriter) latePath() string {
+	return w.path + ".late"
+}
+
+// Values of a metric by series, samples of all CPU cores are summed up
+func csvSeries(metric InstantMetric) (map[string]float64, map[string]string) {
+	values := make(map[string]float64)
+	names := make(map[string]string)
+	for _, sample := range metric.Samples {
+		var labelValues []string
+		var labelNames []string
+		for name := range sample.Labels {
+			if name != "cpu" {
+				labelNames = append(labelNames, name)
+			}
+		}
+		sort.Strings(labelNames)
+		for _, name := range labelNames {
+			labelValues = append(labelValues, sample.Labels[name])
+		}
+		key := strings.Join(append([]string{sample.Name}, labelValues...), "\x00")
+		values[key] += sample.Value
+		names[key] = strings.Join(append([]string{sample.Name}, labelValues...), "_")
+	}
+	return values, names
+}
+
+func (w *CsvWriter) WriteMetric(metric InstantMetric) error {
+	if w.columns == nil {
+		w.pending = append(w.pending, metric)
+		if metric.CommandStatus == CommandStatusPending {
+			return nil
+		}
+		w.writeHeader()
+		for _, pending := range w.pending {
+			w.writeRow(pending)
+		}
+		w.pending = nil
+		return w.file.flush()
+	}
+	return w.writeRow(metric)
+}
+
+// Columns of the series seen so far, in the order of the metric families
+func (w *CsvWriter) writeHeader() {
+	order := make(map[string]int)
+	for i, desc := range w.info.Descs {
+		order[desc.Name] = i
+	}
+	seen := make(map[string]bool)
+	var series []csvColumn
+	for _, metric := range w.pending {
+		_, names := csvSeries(metric)
+		for key, name := range names {
+			if !seen[key] {
+				seen[key] = true
+				family, _, _ := strings.Cut(key, "\x00")
+				series = append(series, csvColumn{name: name, key: key, counter: w.counters[family]})
+			}
+		}
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		familyI, _, _ := strings.Cut(series[i].key, "\x00")
+		familyJ, _, _ := strings.Cut(series[j].key, "\x00")
+		if order[familyI] != order[familyJ] {
+			return order[familyI] < order[familyJ]
+		}
+		return series[i].name < series[j].name
+	})
+	w.columns = series
+
+	header := []string{"timestamp", "ms_since_start", "command_status", "timed_out", "collect_duration_ms"}
+	for _, column := range w.columns {
+		header = append(header, column.name)
+	}
+	for _, column := range w.columns {
+		if column.counter {
+			header = append(header, rateColumnName(column.name))
+		}
+	}
+
+	labels := []string{"job=" + w.info.Job, "instance=" + w.info.Instance, "role=" + w.info.Role}
+	var extra []string
+	for key, value := range w.info.Labels {
+		extra = append(extra, key+"="+value)
+	}
+	sort.Strings(extra)
+	w.file.write(fmt.Sprintf("# statexec %s, interval %s, command: %s\n", w.Version, w.info.Interval, strings.Join(w.info.Command, " ")))
+	w.file.write("# Labels: " + strings.Join(append(labels, extra...), ", ") + "\n")
+	w.file.write(csvLine(header))
+}
+
+// Name of the rate of a counter, e.g. network_sent_bytes_per_second_eth0
+func rateColumnName(name string) string {
+	if strings.Contains(name, "_total") {
+		return strings.Replace(name, "_total", "_per_second", 1)
+	}
+	return name + "_per_second"
+}
+
+func (w *CsvWriter) writeRow(metric InstantMetric) error {
+	values, names := csvSeries(metric)
+	if err := w.writeLateValues(metric, values, names); err != nil {
+		return err
+	}
+	timedOut := "0"
+	if metric.TimedOut {
+		timedOut = "1"
+	}
+	row := []string{
+		strconv.FormatInt(metric.Timestamp, 10),
+		strconv.FormatInt(metric.MsSinceStart, 10),
+		strconv.Itoa(metric.CommandStatus),
+		timedOut,
+		strconv.FormatInt(metric.CollectDuration, 10),
+	}
+	for _, column := range w.columns {
+		value, ok := values[column.key]
+		if !ok {
+			row = append(row, "")
+			continue
+		}
+		row = append(row, formatValue(value))
+	}
+
+	// Rates since the previous row, empty on the first one
+	for _, column := range w.columns {
+		if column.counter {
+			row = append(row, w.rate(column.key, values, metric.Timestamp))
+		}
+	}
+	w.previous = values
+	w.previousTs = metric.Timestamp
+	w.rows++
+	return w.file.write(csvLine(row))
+}
+
+// Rate of a counter since the previous row, empty when unknown
+func (w *CsvWriter) rate(key string, values map[string]float64, timestamp int64) string {
+	value, ok := values[key]
+	previous, hadPrevious := w.previous[key]
+	seconds := float64(timestamp-w.previousTs) / 1000
+	if !ok || !hadPrevious || seconds <= 0 {
+		return ""
+	}
+	return formatValue((value - previous) / seconds)
+}
+
+// Add the series missing from the header to the late ones, and write the
+// value and rate of each late series of the row to the side file
+func (w *CsvWriter) writeLateValues(metric InstantMetric, values map[string]float64, names map[string]string) error {
+	known := make(map[string]bool, len(w.columns)+len(w.late))
+	for _, column := range w.columns {
+		known[column.key] = true
+	}
+	for _, column := range w.late {
+		known[column.key] = true
+	}
+	var added []csvColumn
+	for key, name := range names {
+		if !known[key] {
+			family, _, _ := strings.Cut(key, "\x00")
+			added = append(added, csvColumn{name: name, key: key, counter: w.counters[family]})
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].name < added[j].name })
+	w.late = append(w.late, added...)
+	if len(w.late) == 0 {
+		return nil
+	}
+
+	if w.lateFile == nil {
+		file, err := createLineFile(w.latePath())
+		if err != nil {
+			return fmt.Errorf("creating csv side file: %w", err)
+		}
+		w.lateFile = file
+		w.lateStart = w.rows
+	}
+	var fields []string
+	for _, column := range w.late {
+		value, rate := "", ""
+		if v, ok := values[column.key]; ok {
+			value = formatValue(v)
+		}
+		if column.counter {
+			rate = w.rate(column.key, values, metric.Timestamp)
+		}
+		fields = append(fields, value, rate)
+	}
+	return w.lateFile.write(csvLine(fields))
+}
+
+// Render a CSV line, quoting fields as needed
+func csvLine(fields []string) string {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write(fields)
+	writer.Flush()
+	return buffer.String()
+}
+
+// Write the remaining rows, then the summary file
+func (w *CsvWriter) Close(result *Result) error {
+	if w.columns == nil && len(w.pending) > 0 {
+		// The command never ran
+		w.writeHeader()
+		for _, pending := range w.pending {
+			w.writeRow(pending)
+		}
+	}
+	if err := w.file.close(); err != nil {
+		return fmt.Errorf("writing to csv file: %w", err)
+	}
+	if w.lateFile != nil {
+		if err := w.mergeLateColumns(); err != nil {
+			return err
+		}
+	}
+
+	summaryFile, err := createLineFile(w.summaryPath)
+	if err != nil {
+		return err
+	}
+	summaryFile.write(csvLine([]string{"timestamp", "name", "labels", "value"}))
+	var samples []collectors.Sample
+	samples = append(samples, result.CommandSamples...)
+	samples = append(samples, result.Summary...)
+	for _, sample := range samples {
+		var labels []string
+		for key, value := range sample.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+		summaryFile.write(csvLine([]string{
+			strconv.FormatInt(result.Timestamp, 10),
+			sample.Name,
+			strings.Join(labels, ","),
+			formatValue(sample.Value),
+		}))
+	}
+	if err := summaryFile.close(); err != nil {
+		return fmt.Errorf("writing to csv summary file: %w", err)
+	}
+	return nil
+}
+
+// Rewrite the file with the late series as extra columns, after the other
+// values and after the other rates, in a single pass over both files
+func (w *CsvWriter) mergeLateColumns() error {
+	defer os.Remove(w.latePath())
+	if err := w.lateFile.close(); err != nil {
+		return fmt.Errorf("writing to csv side file: %w", err)
+	}
+	source, err := os.Open(w.path)
+	if err != nil {
+		return fmt.Errorf("merging csv columns: %w", err)
+	}
+	defer source.Close()
+	side, err := os.Open(w.latePath())
+	if err != nil {
+		return fmt.Errorf("merging csv columns: %w", err)
+	}
+	defer side.Close()
+	target, err := createLineFile(w.path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("merging csv columns: %w", err)
+	}
+
+	// Fields of a line: value and rate of each late series
+	sideReader := csv.NewReader(side)
+	sideReader.FieldsPerRecord = -1
+	valuesEnd := 5 + len(w.columns)
+	reader := bufio.NewReader(source)
+	row := -1 // The header
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil && err != io.EOF {
+			target.close()
+			return fmt.Errorf("merging csv columns: %w", err)
+		}
+		if strings.HasPrefix(line, "#") {
+			target.write(line)
+			continue
+		}
+		fields, parseErr := csv.NewReader(strings.NewReader(line)).Read()
+		if parseErr != nil || len(fields) < valuesEnd {
+			target.close()
+			return fmt.Errorf("merging csv columns: unexpected line %q", line)
+		}
+		var lateValues, lateRates []string
+		var sideFields []string
+		if row >= w.lateStart {
+			if sideFields, err = sideReader.Read(); err != nil {
+				target.close()
+				return fmt.Errorf("merging csv columns: %w", err)
+			}
+		}
+		for i, column := range w.late {
+			value, rate := "", ""
+			switch {
+			case row < 0:
+				value, rate = column.name, rateColumnName(column.name)
+			case 2*i+1 < len(sideFields):
+				value, rate = sideFields[2*i], sideFields[2*i+1]
+			}
+			lateValues = append(lateValues, value)
+			if column.counter {
+				lateRates = append(lateRates, rate)
+			}
+		}
+		merged := append(append(append([]string{}, fields[:valuesEnd]...), lateValues...), fields[valuesEnd:]...)
+		target.write(csvLine(append(merged, lateRates...)))
+		row++
+	}
+	if err := target.close(); err != nil {
+		return fmt.Errorf("merging csv columns: %w", err)
+	}
+	return os.Rename(w.path+".tmp", w.path)
+}
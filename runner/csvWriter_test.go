@@ -0,0 +1,68 @@
+package runner
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blackswifthosting/statexec/collectors"
+)
+
+// A network interface appearing while the command runs gets its own columns
+func TestCsvWriterAddsLateSeries(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.csv")
+	writer := NewCsvWriter(path, filepath.Join(dir, "summary.csv"))
+	info := testRunInfo()
+	info.Descs = []collectors.MetricDesc{{Name: "network_received_bytes_total", Type: collectors.TypeCounter}}
+	if err := writer.Start(info); err != nil {
+		t.Fatal(err)
+	}
+	received := func(second int64, interfaces ...string) InstantMetric {
+		metric := InstantMetric{CommandStatus: CommandStatusRunning, MsSinceStart: second * 1000, Timestamp: 1704067200000 + second*1000}
+		for _, name := range interfaces {
+			metric.Samples = append(metric.Samples, collectors.Sample{Name: "network_received_bytes_total", Labels: map[string]string{"interface": name}, Value: float64(second * 100)})
+		}
+		return metric
+	}
+	writer.WriteMetric(received(0, "eth0"))
+	writer.WriteMetric(received(1, "eth0"))
+	writer.WriteMetric(received(2, "eth0", "veth1"))
+	writer.WriteMetric(received(3, "eth0", "veth1"))
+	if err := writer.Close(&Result{}); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := csv.NewReader(strings.NewReader(string(content)))
+	reader.Comment = '#'
+	rows, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"timestamp", "ms_since_start", "command_status", "timed_out", "collect_duration_ms",
+			"network_received_bytes_total_eth0", "network_received_bytes_total_veth1",
+			"network_received_bytes_per_second_eth0", "network_received_bytes_per_second_veth1"},
+		{"1704067200000", "0", "1", "0", "0", "0", "", "", ""},
+		{"1704067201000", "1000", "1", "0", "0", "100", "", "100", ""},
+		{"1704067202000", "2000", "1", "0", "0", "200", "200", "100", ""},
+		{"1704067203000", "3000", "1", "0", "0", "300", "300", "100", "100"},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("got %d rows, expected %d:\n%s", len(rows), len(expected), content)
+	}
+	for i := range expected {
+		if strings.Join(rows[i], ",") != strings.Join(expected[i], ",") {
+			t.Errorf("row %d is %v, expected %v", i, rows[i], expected[i])
+		}
+	}
+	if _, err := os.Stat(path + ".late"); !os.IsNotExist(err) {
+		t.Errorf("side file left behind: %v", err)
+	}
+}
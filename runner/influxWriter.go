@@ -0,0 +1,195 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blackswifthosting/statexec/collectors"
+)
+
+const (
+	// Lines sent in a single InfluxDB write request at most
+	influxBatchSize int = 5000
+	// Measurement of the annotations
+	influxEventMeasurement string = MetricPrefix + "event"
+)
+
+// InfluxWriter writes the run in InfluxDB line protocol: a measurement per
+// metric family with a value field, labels as tags, and annotations in the
+// statexec_event measurement. With a URL, the file is pushed to the InfluxDB
+// v2 write API once the run is over.
+type InfluxWriter struct {
+	Url    string // InfluxDB base URL, e.g. http://localhost:8086, no push when empty
+	Org    string
+	Bucket string
+	Token  string
+	Client *http.Client
+
+	path string
+	file *lineFile
+	info RunInfo
+}
+
+func NewInfluxWriter(path string) *InfluxWriter {
+	return &InfluxWriter{path: path, Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (w *InfluxWriter) Start(info RunInfo) error {
+	file, err := createLineFile(w.path)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.info = info
+	return nil
+}
+
+func (w *InfluxWriter) WriteMetric(metric InstantMetric) error {
+	return w.file.write(w.renderSamples(metricSamples(metric), metric.Timestamp))
+}
+
+// Render samples in line protocol, with nanosecond timestamps
+func (w *InfluxWriter) renderSamples(samples []collectors.Sample, timestamp int64) string {
+	var builder strings.Builder
+	for _, sample := range samples {
+		// Not representable as a float field
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		builder.WriteString(influxEscape(MetricPrefix+sample.Name, ", "))
+		builder.WriteString(w.renderTags(sample.Labels))
+		builder.WriteString(" value=" + strconv.FormatFloat(sample.Value, 'g', -1, 64))
+		builder.WriteString(" " + strconv.FormatInt(timestamp*int64(time.Millisecond), 10) + "\n")
+	}
+	return builder.String()
+}
+
+// Tags of a line: instance, job, role, labels of the sample and extra
+// labels, sorted by key as recommended by InfluxDB
+func (w *InfluxWriter) renderTags(labels map[string]string) string {
+	tags := map[string]string{"instance": w.info.Instance, "job": w.info.Job, "role": w.info.Role}
+	for key, value := range labels {
+		tags[key] = value
+	}
+	for key, value := range w.info.Labels {
+		tags[key] = value
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	for _, key := range keys {
+		// Empty tag values are not allowed
+		if tags[key] == "" {
+			continue
+		}
+		builder.WriteString("," + influxEscape(key, ",= ") + "=" + influxEscape(tags[key], ",= "))
+	}
+	return builder.String()
+}
+
+// Escape special characters of measurements, tag keys and tag values
+func influxEscape(text string, special string) string {
+	var builder strings.Builder
+	for _, char := range text {
+		if char == '\\' || strings.ContainsRune(special, char) {
+			builder.WriteRune('\\')
+		}
+		builder.WriteRune(char)
+	}
+	return builder.String()
+}
+
+// Quote a string field value, new lines are not allowed
+func influxString(text string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", "; ").Replace(text) + `"`
+}
+
+func (w *InfluxWriter) Close(result *Result) error {
+	var buffer strings.Builder
+	for _, annotation := range result.Annotations {
+		// key=value tags of the annotation are part of the series already
+		var kinds []string
+		for _, tag := range annotation.Tags {
+			if !strings.Contains(tag, "=") {
+				kinds = append(kinds, tag)
+			}
+		}
+		buffer.WriteString(influxEventMeasurement + w.renderTags(nil))
+		buffer.WriteString(" text=" + influxString(annotation.Text))
+		buffer.WriteString(",tags=" + influxString(strings.Join(kinds, ",")))
+		buffer.WriteString(",duration_ms=" + strconv.FormatInt(annotation.TimeEnd-annotation.Time, 10) + "i")
+		buffer.WriteString(" " + strconv.FormatInt(annotation.Time*int64(time.Millisecond), 10) + "\n")
+	}
+	buffer.WriteString(w.renderSamples(result.CommandSamples, result.Timestamp))
+	buffer.WriteString(w.renderSamples(result.Summary, result.Timestamp))
+	w.file.write(buffer.String())
+	if err := w.file.close(); err != nil {
+		return fmt.Errorf("writing to influx file: %w", err)
+	}
+
+	if w.Url == "" {
+		return nil
+	}
+	return w.push()
+}
+
+// Send the file to the InfluxDB v2 write API, in batches
+func (w *InfluxWriter) push() error {
+	query := url.Values{}
+	query.Set("org", w.Org)
+	query.Set("bucket", w.Bucket)
+	query.Set("precision", "ns")
+	writeUrl := strings.TrimRight(w.Url, "/") + "/api/v2/write?" + query.Encode()
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.Token != "" {
+		header.Set("Authorization", "Token "+w.Token)
+	}
+
+	file, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var batch strings.Builder
+	lines := 0
+	send := func() error {
+		if lines == 0 {
+			return nil
+		}
+		if err := pushWithRetry(w.Client, writeUrl, header, []byte(batch.String())); err != nil {
+			return fmt.Errorf("influx write to %s: %w", w.Url, err)
+		}
+		batch.Reset()
+		lines = 0
+		return nil
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		batch.WriteString(scanner.Text() + "\n")
+		lines++
+		if lines == influxBatchSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return send()
+}
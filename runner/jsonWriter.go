@@ -0,0 +1,213 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blackswifthosting/statexec/collectors"
+)
+
+// JsonWriter writes the run in JSON Lines, one typed record per line: a
+// header, a sample for every collection with values nested by collector,
+// then annotations, the result of the command and the summary.
+type JsonWriter struct {
+	Version string // Version of statexec, written in the header
+	Config  string // Resolved configuration, written in the header
+
+	path        string
+	file        *lineFile
+	collectorOf map[string]string // Collector of each metric family
+}
+
+type jsonHeader struct {
+	Type      string            `json:"type"`
+	Version   string            `json:"version"`
+	Job       string            `json:"job"`
+	Instance  string            `json:"instance"`
+	Role      string            `json:"role"`
+	Labels    map[string]string `json:"labels"`
+	Interval  string            `json:"interval"`
+	StartTime int64             `json:"startTime"`
+	Command   []string          `json:"command"`
+	Config    string            `json:"config,omitempty"`
+}
+
+type jsonAnnotation struct {
+	Type string `json:"type"`
+	Annotation
+}
+
+type jsonSummary struct {
+	Type      string            `json:"type"`
+	Timestamp int64             `json:"timestamp"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Value     float64           `json:"value"`
+}
+
+func NewJsonWriter(path string) *JsonWriter {
+	return &JsonWriter{Version: "dev", path: path}
+}
+
+func (w *JsonWriter) Start(info RunInfo) error {
+	file, err := createLineFile(w.path)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.collectorOf = make(map[string]string)
+	for _, desc := range info.Descs {
+		w.collectorOf[desc.Name] = desc.Collector
+	}
+
+	labels := info.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	w.writeRecord(jsonHeader{
+		Type:      "header",
+		Version:   w.Version,
+		Job:       info.Job,
+		Instance:  info.Instance,
+		Role:      info.Role,
+		Labels:    labels,
+		Interval:  info.Interval.String(),
+		StartTime: info.StartTime,
+		Command:   info.Command,
+		Config:    w.Config,
+	})
+	return w.file.flush()
+}
+
+func (w *JsonWriter) WriteMetric(metric InstantMetric) error {
+	record := newJsonObject()
+	record.set("type", "sample")
+	record.set("timestamp", metric.Timestamp)
+	record.set("msSinceStart", metric.MsSinceStart)
+	record.set("commandStatus", metric.CommandStatus)
+	record.set("timedOut", metric.TimedOut)
+	record.set("collectDurationMs", metric.CollectDuration)
+	for _, sample := range metric.Samples {
+		// Samples of a collector are nested under its name, e.g. cpu.seconds_total.cpu0.user
+		path := []string{sample.Name}
+		if collector := w.collectorOf[sample.Name]; collector != "" {
+			path = []string{collector, strings.TrimPrefix(sample.Name, collector+"_")}
+		}
+		record.setPath(append(path, labelValues(sample)...), sample.Value)
+	}
+	return w.writeRecord(record)
+}
+
+func (w *JsonWriter) Close(result *Result) error {
+	for _, annotation := range result.Annotations {
+		w.writeRecord(jsonAnnotation{Type: "annotation", Annotation: annotation})
+	}
+
+	record := newJsonObject()
+	record.set("type", "result")
+	record.set("timestamp", result.Timestamp)
+	record.set("exitCode", result.ExitCode)
+	record.set("started", result.Started)
+	record.set("timedOut", result.TimedOut)
+	record.set("interrupted", result.Interrupted)
+	record.set("durationSeconds", result.Duration.Seconds())
+	for _, sample := range result.CommandSamples {
+		if name, ok := strings.CutPrefix(sample.Name, "command_rusage_"); ok {
+			record.setPath(append([]string{"rusage", name}, labelValues(sample)...), sample.Value)
+		}
+	}
+	w.writeRecord(record)
+
+	for _, sample := range result.Summary {
+		w.writeRecord(jsonSummary{
+			Type:      "summary",
+			Timestamp: result.Timestamp,
+			Name:      strings.TrimPrefix(sample.Name, "summary_"),
+			Labels:    sample.Labels,
+			Value:     sample.Value,
+		})
+	}
+
+	if err := w.file.close(); err != nil {
+		return fmt.Errorf("writing to json file: %w", err)
+	}
+	return nil
+}
+
+func (w *JsonWriter) writeRecord(record any) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshalling json record: %w", err)
+	}
+	return w.file.write(string(line) + "\n")
+}
+
+// Label values of a sample, ordered by label name
+func labelValues(sample collectors.Sample) []string {
+	names := make([]string, 0, len(sample.Labels))
+	for name := range sample.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = sample.Labels[name]
+	}
+	return values
+}
+
+// JSON object keeping the order of its keys
+type jsonObject struct {
+	keys   []string
+	values map[string]any
+}
+
+func newJsonObject() *jsonObject {
+	return &jsonObject{values: make(map[string]any)}
+}
+
+func (o *jsonObject) set(key string, value any) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// Set a value in nested objects, created as needed
+func (o *jsonObject) setPath(path []string, value any) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := o.values[key].(*jsonObject)
+		if !ok {
+			child = newJsonObject()
+			o.set(key, child)
+		}
+		o = child
+	}
+	o.set(path[len(path)-1], value)
+}
+
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	for i, key := range o.keys {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		keyJson, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		valueJson, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(keyJson)
+		buffer.WriteString(":")
+		buffer.Write(valueJson)
+	}
+	buffer.WriteString("}")
+	return buffer.Bytes(), nil
+}
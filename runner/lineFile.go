@@ -0,0 +1,60 @@
+package runner
+
+import (
+	"bytes"
+	"os"
+	"time"
+)
+
+const (
+	// Pending lines are written to the file at least this often
+	flushInterval time.Duration = 1 * time.Second
+	// Pending lines are written as soon as they exceed this size
+	flushSize int = 1024 * 1024
+)
+
+// Output file written by whole lines: lines are rendered in memory and
+// written with a single write, so that the file only ever contains complete
+// lines and stays valid if statexec is killed.
+type lineFile struct {
+	file      *os.File
+	pending   bytes.Buffer
+	lastFlush time.Time
+	err       error // First write error, returned by close
+}
+
+func createLineFile(path string) (*lineFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &lineFile{file: file, lastFlush: time.Now()}, nil
+}
+
+// Add complete lines, written once the flush interval or size is reached
+func (f *lineFile) write(lines string) error {
+	f.pending.WriteString(lines)
+	if time.Since(f.lastFlush) >= flushInterval || f.pending.Len() >= flushSize {
+		f.flush()
+	}
+	return f.err
+}
+
+// Write pending lines to the file, in a single write
+func (f *lineFile) flush() error {
+	if f.err == nil && f.pending.Len() > 0 {
+		_, f.err = f.file.Write(f.pending.Bytes())
+	}
+	f.pending.Reset()
+	f.lastFlush = time.Now()
+	return f.err
+}
+
+// Write pending lines and close the file
+func (f *lineFile) close() error {
+	f.flush()
+	if err := f.file.Close(); err != nil && f.err == nil {
+		f.err = err
+	}
+	return f.err
+}
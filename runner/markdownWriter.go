@@ -0,0 +1,270 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Characters of a sparkline, from the lowest to the highest value
+	sparklineLevels string = "▁▂▃▄▅▆▇█"
+	// Width of a sparkline, longer runs are averaged down
+	sparklineWidth int = 30
+)
+
+// MarkdownWriter writes a human summary of the run in Markdown once it is
+// over, e.g. for CI job pages: the result of the command and a table of the
+// summary values, with a sparkline of each resource over the run.
+type MarkdownWriter struct {
+	Append bool // Append to the file instead of replacing it, as for GITHUB_STEP_SUMMARY
+
+	path     string
+	info     RunInfo
+	previous *InstantMetric
+	history  map[string]*sparklineValues // Values over the run of each row, by row key
+}
+
+func NewMarkdownWriter(path string) *MarkdownWriter {
+	return &MarkdownWriter{path: path}
+}
+
+func (w *MarkdownWriter) Start(info RunInfo) error {
+	w.info = info
+	w.previous = nil
+	w.history = make(map[string]*sparklineValues)
+	return nil
+}
+
+// Values of a sparkline, averaged down as they come so that memory does not
+// grow with the length of the run: consecutive values are summed in up to
+// twice the sparkline width buckets, pairs of buckets are merged when full.
+type sparklineValues struct {
+	sums   []float64
+	counts []int
+	span   int // Values of a full bucket
+}
+
+func (v *sparklineValues) add(value float64) {
+	last := len(v.sums) - 1
+	if last < 0 || v.counts[last] >= v.span {
+		if len(v.sums) == 2*sparklineWidth {
+			for i := 0; i < sparklineWidth; i++ {
+				v.sums[i] = v.sums[2*i] + v.sums[2*i+1]
+				v.counts[i] = v.counts[2*i] + v.counts[2*i+1]
+			}
+			v.sums = v.sums[:sparklineWidth]
+			v.counts = v.counts[:sparklineWidth]
+			v.span *= 2
+		}
+		v.sums = append(v.sums, 0)
+		v.counts = append(v.counts, 0)
+		last = len(v.sums) - 1
+	}
+	v.sums[last] += value
+	v.counts[last]++
+}
+
+// Mean value of each bucket, nil if none was added
+func (v *sparklineValues) values() []float64 {
+	if v == nil {
+		return nil
+	}
+	values := make([]float64, len(v.sums))
+	for i := range values {
+		values[i] = v.sums[i] / float64(v.counts[i])
+	}
+	return values
+}
+
+// Add a value to the sparkline of a row
+func (w *MarkdownWriter) addValue(key string, value float64) {
+	values, ok := w.history[key]
+	if !ok {
+		values = &sparklineValues{span: 1}
+		w.history[key] = values
+	}
+	values.add(value)
+}
+
+// Keep the values of the sparklines: gauges as is, counters as rates
+func (w *MarkdownWriter) WriteMetric(metric InstantMetric) error {
+	if used := sumSamples(metric.Samples, "memory_used_bytes", ""); len(used) > 0 {
+		w.addValue("memory", used[""])
+	}
+	if resident := sumSamples(metric.Samples, "process_resident_memory_bytes", ""); len(resident) > 0 {
+		w.addValue("process_memory", resident[""])
+	}
+
+	previous := w.previous
+	w.previous = &metric
+	if previous == nil || metric.Timestamp <= previous.Timestamp {
+		return nil
+	}
+	seconds := float64(metric.Timestamp-previous.Timestamp) / 1000
+	addRates := func(name string, groupBy string, key string) {
+		start := sumSamples(previous.Samples, name, groupBy)
+		for group, value := range sumSamples(metric.Samples, name, groupBy) {
+			if startValue, ok := start[group]; ok {
+				w.addValue(key+group, max(value-startValue, 0)/seconds)
+			}
+		}
+	}
+	addRates("cpu_seconds_total", "mode", "cpu_")
+	addRates("network_received_bytes_total", "", "network_received")
+	addRates("network_sent_bytes_total", "", "network_sent")
+	addRates("disk_read_bytes_total", "", "disk_read")
+	addRates("disk_write_bytes_total", "", "disk_write")
+	return nil
+}
+
+// Render values as a sparkline from their minimum to their maximum
+func sparkline(values []float64) string {
+	if len(values) == 0 {
+		return ""
+	}
+	// Average consecutive values down to the width
+	if len(values) > sparklineWidth {
+		averaged := make([]float64, sparklineWidth)
+		for i := range averaged {
+			from := i * len(values) / sparklineWidth
+			to := (i + 1) * len(values) / sparklineWidth
+			for _, value := range values[from:to] {
+				averaged[i] += value
+			}
+			averaged[i] /= float64(to - from)
+		}
+		values = averaged
+	}
+
+	minValue, maxValue := values[0], values[0]
+	for _, value := range values {
+		minValue = min(minValue, value)
+		maxValue = max(maxValue, value)
+	}
+	levels := []rune(sparklineLevels)
+	var builder strings.Builder
+	for _, value := range values {
+		level := 0
+		if maxValue > minValue {
+			level = min(int((value-minValue)/(maxValue-minValue)*float64(len(levels)-1)+0.5), len(levels)-1)
+		}
+		builder.WriteRune(levels[level])
+	}
+	return builder.String()
+}
+
+// Format a number of bytes with a binary prefix, e.g. 1.5 MiB
+func formatBytes(value float64) string {
+	prefixes := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for value >= 1024 && i < len(prefixes)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f B", value)
+	}
+	return fmt.Sprintf("%.1f %s", value, prefixes[i])
+}
+
+func (w *MarkdownWriter) Close(result *Result) error {
+	summary := make(map[string]float64)
+	var cpuModes []string
+	for _, sample := range result.Summary {
+		if mode, ok := sample.Labels["mode"]; ok {
+			if sample.Name == "summary_cpu_mean_seconds" {
+				summary["cpu_"+mode] = sample.Value
+				cpuModes = append(cpuModes, mode)
+			}
+			continue
+		}
+		summary[sample.Name] = sample.Value
+	}
+	// User and system first, as they matter most
+	modeOrder := map[string]int{"user": -2, "system": -1}
+	sort.Slice(cpuModes, func(i, j int) bool {
+		if modeOrder[cpuModes[i]] != modeOrder[cpuModes[j]] {
+			return modeOrder[cpuModes[i]] < modeOrder[cpuModes[j]]
+		}
+		return cpuModes[i] < cpuModes[j]
+	})
+
+	var buffer strings.Builder
+	command := strings.ReplaceAll(strings.Join(w.info.Command, " "), "`", "'")
+	fmt.Fprintf(&buffer, "### statexec: `%s`\n\n", command)
+	fmt.Fprintf(&buffer, "Instance `%s`, role `%s`, interval %s\n\n", w.info.Instance, w.info.Role, w.info.Interval)
+
+	status := fmt.Sprintf("%d", result.ExitCode)
+	switch {
+	case !result.Started:
+		status += " (not started)"
+	case result.TimedOut:
+		status += " (timed out)"
+	case result.Interrupted:
+		status += " (interrupted)"
+	}
+	buffer.WriteString("| Result | |\n|---|---|\n")
+	fmt.Fprintf(&buffer, "| Exit code | %s |\n", status)
+	fmt.Fprintf(&buffer, "| Duration | %s |\n\n", result.Duration.Round(time.Millisecond))
+
+	if len(result.Summary) == 0 {
+		buffer.WriteString("No summary, the command was not seen both running and done.\n\n")
+		return w.write(buffer.String())
+	}
+
+	buffer.WriteString("| Resource | Mean while running | Over the run |\n|---|---:|---|\n")
+	row := func(name string, value string, key string) {
+		fmt.Fprintf(&buffer, "| %s | %s | %s |\n", name, value, sparkline(w.history[key].values()))
+	}
+	for _, mode := range cpuModes {
+		// Idle is the complement of the others, unused modes are left out
+		if mode == "idle" || (summary["cpu_"+mode] == 0 && mode != "user" && mode != "system") {
+			continue
+		}
+		row("CPU "+mode, fmt.Sprintf("%.2f cores", summary["cpu_"+mode]), "cpu_"+mode)
+	}
+	if cores, ok := summary["summary_cpu_cores"]; ok {
+		fmt.Fprintf(&buffer, "| CPU cores | %.0f | |\n", cores)
+	}
+	if used, ok := summary["summary_memory_used_bytes"]; ok {
+		value := formatBytes(used)
+		if total, ok := summary["summary_memory_total_bytes"]; ok {
+			value += " of " + formatBytes(total)
+		}
+		row("Memory used", value, "memory")
+	}
+	if resident, ok := summary["summary_process_max_resident_memory_bytes"]; ok {
+		row("Command max resident memory", formatBytes(resident), "process_memory")
+	}
+	for _, throughput := range []struct{ name, summaryName, key string }{
+		{"Network received", "summary_network_mean_received_bytes_per_second", "network_received"},
+		{"Network sent", "summary_network_mean_sent_bytes_per_second", "network_sent"},
+		{"Disk read", "summary_disk_mean_read_bytes_per_second", "disk_read"},
+		{"Disk written", "summary_disk_mean_write_bytes_per_second", "disk_write"},
+	} {
+		if value, ok := summary[throughput.summaryName]; ok {
+			row(throughput.name, formatBytes(value)+"/s", throughput.key)
+		}
+	}
+	buffer.WriteString("\n")
+	return w.write(buffer.String())
+}
+
+func (w *MarkdownWriter) write(content string) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if w.Append {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(w.path, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("writing markdown summary: %w", err)
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return fmt.Errorf("writing markdown summary: %w", err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,33 @@
+package runner
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// Long runs keep a bounded number of values, with about the same sparkline
+// as when every value is kept: buckets do not end exactly where the
+// sparkline averages values down
+func TestSparklineValuesAreBounded(t *testing.T) {
+	var all []float64
+	values := &sparklineValues{span: 1}
+	for i := 0; i < 100000; i++ {
+		value := math.Sin(float64(i)/10000) * 100
+		all = append(all, value)
+		values.add(value)
+	}
+	if len(values.sums) > 2*sparklineWidth {
+		t.Fatalf("%d values kept, expected at most %d", len(values.sums), 2*sparklineWidth)
+	}
+	got, expected := []rune(sparkline(values.values())), []rune(sparkline(all))
+	if len(got) != len(expected) {
+		t.Fatalf("sparkline %s, expected %s", string(got), string(expected))
+	}
+	levels := []rune(sparklineLevels)
+	for i := range got {
+		if math.Abs(float64(slices.Index(levels, got[i])-slices.Index(levels, expected[i]))) > 1 {
+			t.Fatalf("sparkline %s, expected %s", string(got), string(expected))
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package runner
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/blackswifthosting/statexec/collectors"
+)
+
+// MetricsHandler is a Writer serving the latest collected metrics on a
+// prometheus /metrics endpoint, so that long runs can be scraped live.
+// Samples have no timestamp, the scraper sets its own.
+type MetricsHandler struct {
+	mutex  sync.Mutex
+	info   RunInfo
+	latest *InstantMetric
+	result *Result
+}
+
+func NewMetricsHandler() *MetricsHandler {
+	return &MetricsHandler{}
+}
+
+func (h *MetricsHandler) Start(info RunInfo) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.info = info
+	h.latest = nil
+	h.result = nil
+	return nil
+}
+
+func (h *MetricsHandler) WriteMetric(metric InstantMetric) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.latest = &metric
+	return nil
+}
+
+// Keep serving the last metrics, along with the result of the command
+func (h *MetricsHandler) Close(result *Result) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.result = result
+	return nil
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if h.latest == nil {
+		// Nothing collected yet, e.g. a server waiting for its client
+		return
+	}
+
+	samples := metricSamples(*h.latest)
+	if h.result != nil {
+		samples = append(samples, h.result.CommandSamples...)
+	}
+
+	// Samples of a family must be contiguous, families are written in declaration order
+	byName := make(map[string][]collectors.Sample)
+	for _, sample := range samples {
+		byName[sample.Name] = append(byName[sample.Name], sample)
+	}
+	var builder strings.Builder
+	for _, desc := range h.info.Descs {
+		familySamples := byName[desc.Name]
+		if len(familySamples) == 0 {
+			continue
+		}
+		fmt.Fprintf(&builder, "# HELP %s%s %s\n", MetricPrefix, desc.Name, desc.Help)
+		fmt.Fprintf(&builder, "# TYPE %s%s %s\n", MetricPrefix, desc.Name, desc.Type)
+		for _, sample := range familySamples {
+			fmt.Fprintf(&builder, "%s%s{%s} %s\n", MetricPrefix, sample.Name, renderLabels(h.info, sample.Labels), formatValue(sample.Value))
+		}
+	}
+	fmt.Fprint(w, builder.String())
+}
@@ -0,0 +1,381 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blackswifthosting/statexec/collectors"
+	"golang.org/x/net/http2"
+)
+
+const (
+	OtlpProtocolHttp string = "http/protobuf"
+	OtlpProtocolGrpc string = "grpc"
+
+	// Data points sent in a single OTLP request at most
+	otlpBatchSize int = 10000
+	// Data points are sent once they are this old at most
+	otlpFlushInterval time.Duration = 30 * time.Second
+
+	// OTLP enums
+	otlpTemporalityCumulative uint64 = 2
+	otlpSeverityInfo          uint64 = 9
+)
+
+// Paths of the OTLP services, for HTTP and gRPC
+var otlpPaths = map[string]map[string]string{
+	OtlpProtocolHttp: {"metrics": "/v1/metrics", "logs": "/v1/logs"},
+	OtlpProtocolGrpc: {
+		"metrics": "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export",
+		"logs":    "/opentelemetry.proto.collector.logs.v1.LogsService/Export",
+	},
+}
+
+// OtlpWriter exports the run to an OpenTelemetry collector: counters as
+// cumulative sums and gauges as gauges, with the original timestamps, in
+// batches sent in the background while the command runs, then annotations
+// as log records once the run is over. instance, job, role and extra labels
+// are resource attributes.
+type OtlpWriter struct {
+	Version       string
+	Protocol      string            // OtlpProtocolHttp or OtlpProtocolGrpc
+	Headers       map[string]string // Sent with every request, e.g. for authentication
+	Insecure      bool              // Plain text when the endpoint has no scheme
+	BatchSize     int               // Data points per request at most (default: 10000)
+	FlushInterval time.Duration     // Age of the oldest data point waiting to be sent at most (default: 30s)
+
+	endpoint string
+	client   *http.Client
+	info     RunInfo
+	queue    *pushQueue
+
+	// Batch being filled
+	families map[string]*otlpFamily
+	order    []string // Families in the order they were first seen in the batch
+	points   int
+	since    time.Time // When the first data point of the batch was added
+}
+
+type otlpFamily struct {
+	desc   collectors.MetricDesc
+	points []otlpPoint
+}
+
+type otlpPoint struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64 // In milliseconds
+}
+
+// Endpoint is a base URL for HTTP, e.g. http://localhost:4318, and an
+// address for gRPC, e.g. localhost:4317, with an optional scheme
+func NewOtlpWriter(endpoint string) *OtlpWriter {
+	return &OtlpWriter{
+		Version:       "dev",
+		Protocol:      OtlpProtocolHttp,
+		BatchSize:     otlpBatchSize,
+		FlushInterval: otlpFlushInterval,
+		endpoint:      endpoint,
+	}
+}
+
+func (w *OtlpWriter) Start(info RunInfo) error {
+	w.info = info
+	w.families = make(map[string]*otlpFamily)
+	w.order = nil
+	w.points = 0
+	for _, desc := range info.Descs {
+		w.families[desc.Name] = &otlpFamily{desc: desc}
+	}
+
+	switch w.Protocol {
+	case OtlpProtocolHttp:
+		w.client = &http.Client{Timeout: 30 * time.Second}
+	case OtlpProtocolGrpc:
+		transport := &http2.Transport{}
+		if strings.HasPrefix(w.baseUrl(), "http://") {
+			// gRPC without TLS, HTTP/2 with prior knowledge
+			transport.AllowHTTP = true
+			transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}
+		}
+		w.client = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	default:
+		return fmt.Errorf("unknown OTLP protocol %q", w.Protocol)
+	}
+	w.queue = newPushQueue(func(message []byte) error { return w.export("metrics", message) })
+	return nil
+}
+
+// Endpoint with a scheme, https unless insecure
+func (w *OtlpWriter) baseUrl() string {
+	endpoint := strings.TrimRight(w.endpoint, "/")
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		return endpoint
+	}
+	if w.Insecure {
+		return "http://" + endpoint
+	}
+	return "https://" + endpoint
+}
+
+func (w *OtlpWriter) WriteMetric(metric InstantMetric) error {
+	w.add(metricSamples(metric), metric.Timestamp)
+	if w.points > 0 && time.Since(w.since) >= w.FlushInterval {
+		w.flush()
+	}
+	return nil
+}
+
+// Add data points to the batch, which is sent once full
+func (w *OtlpWriter) add(samples []collectors.Sample, timestamp int64) {
+	for _, sample := range samples {
+		family, ok := w.families[sample.Name]
+		if !ok {
+			// Not described, e.g. the summary
+			family = &otlpFamily{desc: collectors.MetricDesc{Name: sample.Name, Type: collectors.TypeGauge}}
+			w.families[sample.Name] = family
+		}
+		if len(family.points) == 0 {
+			w.order = append(w.order, sample.Name)
+		}
+		family.points = append(family.points, otlpPoint{labels: sample.Labels, value: sample.Value, timestamp: timestamp})
+		if w.points == 0 {
+			w.since = time.Now()
+		}
+		w.points++
+		if w.points >= w.BatchSize {
+			w.flush()
+		}
+	}
+}
+
+// Queue the batch as an export request, and start a new one
+func (w *OtlpWriter) flush() {
+	if w.points == 0 {
+		return
+	}
+	var metrics [][]byte
+	for _, name := range w.order {
+		family := w.families[name]
+		metrics = append(metrics, w.encodeMetric(family.desc, family.points))
+		family.points = nil
+	}
+	w.queue.push(w.encodeRequest(metrics), w.points)
+	w.order = nil
+	w.points = 0
+}
+
+// Send the last batch with the command samples and the summary, wait for
+// the requests still queued, then export the annotations
+func (w *OtlpWriter) Close(result *Result) error {
+	w.add(result.CommandSamples, result.Timestamp)
+	w.add(result.Summary, result.Timestamp)
+	w.flush()
+	var errs []error
+	if err := w.queue.close(); err != nil {
+		errs = append(errs, fmt.Errorf("OTLP metrics export to %s: %w", w.url("metrics"), err))
+	}
+
+	if len(result.Annotations) > 0 {
+		var logs [][]byte
+		for _, annotation := range result.Annotations {
+			logs = append(logs, encodeLogRecord(annotation))
+		}
+		if err := w.export("logs", w.encodeRequest(logs)); err != nil {
+			errs = append(errs, fmt.Errorf("OTLP logs export to %s: %w", w.url("logs"), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Encode a metric of a family:
+//
+//	Metric          { string name = 1; string description = 2; Gauge gauge = 5; Sum sum = 7; }
+//	Gauge           { repeated NumberDataPoint data_points = 1; }
+//	Sum             { repeated NumberDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; bool is_monotonic = 3; }
+//	NumberDataPoint { repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3; double as_double = 4; }
+func (w *OtlpWriter) encodeMetric(desc collectors.MetricDesc, points []otlpPoint) []byte {
+	counter := desc.Type == collectors.TypeCounter
+	var data []byte
+	for _, point := range points {
+		var dataPoint []byte
+		for _, key := range sortedLabelKeys(point.labels) {
+			dataPoint = appendBytesField(dataPoint, 7, encodeKeyValue(key, point.labels[key]))
+		}
+		if counter {
+			dataPoint = appendFixed64Field(dataPoint, 2, uint64(w.info.StartTime*int64(time.Millisecond)))
+		}
+		dataPoint = appendFixed64Field(dataPoint, 3, uint64(point.timestamp*int64(time.Millisecond)))
+		dataPoint = appendDoubleField(dataPoint, 4, point.value)
+		data = appendBytesField(data, 1, dataPoint)
+	}
+
+	var metric []byte
+	metric = appendStringField(metric, 1, MetricPrefix+desc.Name)
+	metric = appendStringField(metric, 2, desc.Help)
+	if counter {
+		data = appendVarintField(data, 2, otlpTemporalityCumulative)
+		data = appendVarintField(data, 3, 1)
+		return appendBytesField(metric, 7, data)
+	}
+	return appendBytesField(metric, 5, data)
+}
+
+// Encode a log record from an annotation:
+//
+//	LogRecord { fixed64 time_unix_nano = 1; SeverityNumber severity_number = 2; string severity_text = 3; AnyValue body = 5; repeated KeyValue attributes = 6; }
+func encodeLogRecord(annotation Annotation) []byte {
+	// key=value tags are resource attributes already
+	var kinds []string
+	for _, tag := range annotation.Tags {
+		if !strings.Contains(tag, "=") {
+			kinds = append(kinds, tag)
+		}
+	}
+	var record []byte
+	record = appendFixed64Field(record, 1, uint64(annotation.Time*int64(time.Millisecond)))
+	record = appendVarintField(record, 2, otlpSeverityInfo)
+	record = appendStringField(record, 3, "INFO")
+	record = appendBytesField(record, 5, encodeStringValue(annotation.Text))
+	record = appendBytesField(record, 6, encodeKeyValue("statexec.tags", strings.Join(kinds, ",")))
+	var duration []byte
+	duration = appendStringField(duration, 1, "statexec.duration_ms")
+	duration = appendBytesField(duration, 2, appendVarintField(nil, 3, uint64(annotation.TimeEnd-annotation.Time)))
+	return appendBytesField(record, 6, duration)
+}
+
+// Encode an export request of metrics or log records, wrapped in their
+// resource and scope:
+//
+//	Export*ServiceRequest { repeated Resource* resource_* = 1; }
+//	Resource*             { Resource resource = 1; repeated Scope* scope_* = 2; }
+//	Resource              { repeated KeyValue attributes = 1; }
+//	Scope*                { InstrumentationScope scope = 1; repeated items = 2; }
+//	InstrumentationScope  { string name = 1; string version = 2; }
+func (w *OtlpWriter) encodeRequest(items [][]byte) []byte {
+	attributes := map[string]string{
+		"service.name":        w.info.Job,
+		"service.instance.id": w.info.Instance,
+		"instance":            w.info.Instance,
+		"job":                 w.info.Job,
+		"role":                w.info.Role,
+	}
+	for key, value := range w.info.Labels {
+		attributes[key] = value
+	}
+	var resource []byte
+	for _, key := range sortedLabelKeys(attributes) {
+		resource = appendBytesField(resource, 1, encodeKeyValue(key, attributes[key]))
+	}
+
+	var scope []byte
+	scope = appendStringField(scope, 1, "statexec")
+	scope = appendStringField(scope, 2, w.Version)
+	var scoped []byte
+	scoped = appendBytesField(scoped, 1, scope)
+	for _, item := range items {
+		scoped = appendBytesField(scoped, 2, item)
+	}
+
+	var resourceItems []byte
+	resourceItems = appendBytesField(resourceItems, 1, resource)
+	resourceItems = appendBytesField(resourceItems, 2, scoped)
+	return appendBytesField(nil, 1, resourceItems)
+}
+
+// KeyValue { string key = 1; AnyValue value = 2; }
+func encodeKeyValue(key string, value string) []byte {
+	var keyValue []byte
+	keyValue = appendStringField(keyValue, 1, key)
+	return appendBytesField(keyValue, 2, encodeStringValue(value))
+}
+
+// AnyValue { string string_value = 1; }
+func encodeStringValue(value string) []byte {
+	return appendStringField(nil, 1, value)
+}
+
+func sortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// URL of the export service of a signal, metrics or logs
+func (w *OtlpWriter) url(signal string) string {
+	return w.baseUrl() + otlpPaths[w.Protocol][signal]
+}
+
+// Send an export request of a signal, retrying on transient errors
+func (w *OtlpWriter) export(signal string, message []byte) error {
+	url := w.url(signal)
+	header := http.Header{}
+	for key, value := range w.Headers {
+		header.Set(key, value)
+	}
+	if w.Protocol == OtlpProtocolGrpc {
+		return withRetry(func() (bool, error) { return w.grpcCall(url, header, message) })
+	}
+	header.Set("Content-Type", "application/x-protobuf")
+	return pushWithRetry(w.client, url, header, message)
+}
+
+// Unary gRPC call, tells whether it is worth retrying on error
+func (w *OtlpWriter) grpcCall(url string, header http.Header, message []byte) (bool, error) {
+	// Length-prefixed message, not compressed
+	body := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(message)))
+	body = append(body, message...)
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header = header.Clone()
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	request.Header.Set("User-Agent", "statexec")
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	// Trailers are only read along with the body
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode != http.StatusOK {
+		return response.StatusCode/100 == 5, fmt.Errorf("%s", response.Status)
+	}
+
+	status := response.Trailer.Get("Grpc-Status")
+	grpcMessage := response.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// Trailers-only response
+		status = response.Header.Get("Grpc-Status")
+		grpcMessage = response.Header.Get("Grpc-Message")
+	}
+	switch status {
+	case "0":
+		return false, nil
+	case "":
+		return false, fmt.Errorf("missing gRPC status")
+	}
+	// Retryable codes: deadline exceeded, resource exhausted, aborted, unavailable
+	retry := status == "4" || status == "8" || status == "10" || status == "14"
+	return retry, fmt.Errorf("gRPC status %s: %s", status, grpcMessage)
+}
@@ -0,0 +1,351 @@
+package runner
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blackswifthosting/statexec/collectors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+type otlpTestMetric struct {
+	name        string
+	help        string
+	sum         bool
+	temporality uint64
+	monotonic   bool
+	points      []otlpTestPoint
+}
+
+type otlpTestPoint struct {
+	attributes map[string]string
+	start      uint64
+	time       uint64
+	value      float64
+}
+
+type otlpTestLog struct {
+	time       uint64
+	severity   uint64
+	body       string
+	attributes map[string]string
+}
+
+// Local OTLP receiver over HTTP or gRPC, decoding the export requests
+type otlpReceiver struct {
+	*httptest.Server
+	t        *testing.T
+	mutex    sync.Mutex
+	requests map[string]int // By path
+	statuses []int          // HTTP or gRPC status of each request, success once they are used up
+	resource map[string]string
+	scope    [2]string // Name and version
+	metrics  []otlpTestMetric
+	logs     []otlpTestLog
+}
+
+func newOtlpReceiver(t *testing.T, grpc bool, statuses ...int) *otlpReceiver {
+	receiver := &otlpReceiver{t: t, requests: make(map[string]int), statuses: statuses}
+	if grpc {
+		// gRPC without TLS, HTTP/2 with prior knowledge
+		receiver.Server = httptest.NewServer(h2c.NewHandler(http.HandlerFunc(receiver.serveGrpc), &http2.Server{}))
+	} else {
+		receiver.Server = httptest.NewServer(http.HandlerFunc(receiver.serveHttp))
+	}
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+// Status of the next request
+func (r *otlpReceiver) nextStatus(success int) int {
+	if len(r.statuses) == 0 {
+		return success
+	}
+	status := r.statuses[0]
+	r.statuses = r.statuses[1:]
+	return status
+}
+
+func (r *otlpReceiver) serveHttp(response http.ResponseWriter, request *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requests[request.URL.Path]++
+	if status := r.nextStatus(http.StatusOK); status != http.StatusOK {
+		http.Error(response, "failing on purpose", status)
+		return
+	}
+	if request.Header.Get("Content-Type") != "application/x-protobuf" || request.Header.Get("Authorization") != "Bearer token" {
+		r.t.Errorf("unexpected headers %v", request.Header)
+	}
+	body, _ := io.ReadAll(request.Body)
+	r.decode(request.URL.Path, body)
+}
+
+func (r *otlpReceiver) serveGrpc(response http.ResponseWriter, request *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requests[request.URL.Path]++
+	if request.ProtoMajor != 2 || request.Header.Get("Content-Type") != "application/grpc" || request.Header.Get("TE") != "trailers" {
+		r.t.Errorf("unexpected gRPC request %s %v", request.Proto, request.Header)
+	}
+	if request.Header.Get("Authorization") != "Bearer token" {
+		r.t.Errorf("unexpected Authorization %q", request.Header.Get("Authorization"))
+	}
+
+	// Length-prefixed message, not compressed
+	body, _ := io.ReadAll(request.Body)
+	if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		r.t.Errorf("invalid gRPC framing of %d bytes", len(body))
+		return
+	}
+	status := r.nextStatus(0)
+	if status == 0 {
+		r.decode(request.URL.Path, body[5:])
+	}
+	response.Header().Set("Content-Type", "application/grpc")
+	response.Write(make([]byte, 5))
+	response.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(status))
+	if status != 0 {
+		response.Header().Set(http.TrailerPrefix+"Grpc-Message", "failing on purpose")
+	}
+}
+
+// Attributes of KeyValue fields, with string or int values
+func (r *otlpReceiver) attributes(fields []protoField) map[string]string {
+	attributes := make(map[string]string)
+	for _, field := range fields {
+		key := protoString(r.t, field.bytes, 1)
+		value := protoFields(decodeProto(r.t, field.bytes), 2)[0].bytes
+		if ints := protoFields(decodeProto(r.t, value), 3); len(ints) > 0 {
+			attributes[key] = strconv.FormatUint(ints[0].value, 10)
+		} else {
+			attributes[key] = protoString(r.t, value, 1)
+		}
+	}
+	return attributes
+}
+
+// Decode an export request of metrics or logs
+func (r *otlpReceiver) decode(path string, body []byte) {
+	for _, resourceItems := range protoFields(decodeProto(r.t, body), 1) {
+		fields := decodeProto(r.t, resourceItems.bytes)
+		r.resource = r.attributes(protoFields(decodeProto(r.t, protoFields(fields, 1)[0].bytes), 1))
+		for _, scoped := range protoFields(fields, 2) {
+			scopedFields := decodeProto(r.t, scoped.bytes)
+			scope := protoFields(scopedFields, 1)[0].bytes
+			r.scope = [2]string{protoString(r.t, scope, 1), protoString(r.t, scope, 2)}
+			for _, item := range protoFields(scopedFields, 2) {
+				if strings.HasSuffix(path, "metrics") || strings.HasSuffix(path, "MetricsService/Export") {
+					r.metrics = append(r.metrics, r.decodeMetric(item.bytes))
+				} else {
+					r.logs = append(r.logs, r.decodeLog(item.bytes))
+				}
+			}
+		}
+	}
+}
+
+func (r *otlpReceiver) decodeMetric(message []byte) otlpTestMetric {
+	fields := decodeProto(r.t, message)
+	metric := otlpTestMetric{name: protoString(r.t, message, 1), help: protoString(r.t, message, 2)}
+	data := protoFields(fields, 5)
+	if sum := protoFields(fields, 7); len(sum) > 0 {
+		metric.sum = true
+		data = sum
+	}
+	dataFields := decodeProto(r.t, data[0].bytes)
+	if metric.sum {
+		metric.temporality = protoFields(dataFields, 2)[0].value
+		metric.monotonic = protoFields(dataFields, 3)[0].value == 1
+	}
+	for _, dataPoint := range protoFields(dataFields, 1) {
+		pointFields := decodeProto(r.t, dataPoint.bytes)
+		point := otlpTestPoint{
+			attributes: r.attributes(protoFields(pointFields, 7)),
+			time:       protoFields(pointFields, 3)[0].value,
+			value:      math.Float64frombits(protoFields(pointFields, 4)[0].value),
+		}
+		if start := protoFields(pointFields, 2); len(start) > 0 {
+			point.start = start[0].value
+		}
+		metric.points = append(metric.points, point)
+	}
+	return metric
+}
+
+func (r *otlpReceiver) decodeLog(message []byte) otlpTestLog {
+	fields := decodeProto(r.t, message)
+	return otlpTestLog{
+		time:       protoFields(fields, 1)[0].value,
+		severity:   protoFields(fields, 2)[0].value,
+		body:       protoString(r.t, protoFields(fields, 5)[0].bytes, 1),
+		attributes: r.attributes(protoFields(fields, 6)),
+	}
+}
+
+func (r *otlpReceiver) requestCount(path string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.requests[path]
+}
+
+func newTestOtlpWriter(receiver *otlpReceiver, protocol string) *OtlpWriter {
+	endpoint := receiver.URL
+	if protocol == OtlpProtocolGrpc {
+		// An address without scheme, as given on the command line
+		endpoint = strings.TrimPrefix(receiver.URL, "http://")
+	}
+	writer := NewOtlpWriter(endpoint)
+	writer.Protocol = protocol
+	writer.Insecure = true
+	writer.Version = "1.2.3"
+	writer.Headers = map[string]string{"Authorization": "Bearer token"}
+	return writer
+}
+
+func testOtlpExport(t *testing.T, protocol string, metricsPath string, logsPath string) {
+	receiver := newOtlpReceiver(t, protocol == OtlpProtocolGrpc)
+	writer := newTestOtlpWriter(receiver, protocol)
+	// A collection has 5 data points, a batch is sent every 2 collections
+	writer.BatchSize = 10
+	info := testRunInfo()
+	info.Descs = []collectors.MetricDesc{
+		{Name: "command_status", Help: "Status of the command", Type: collectors.TypeGauge},
+		{Name: "cpu_seconds_total", Help: "CPU time", Type: collectors.TypeCounter},
+	}
+	if err := writer.Start(info); err != nil {
+		t.Fatal(err)
+	}
+	for second := int64(0); second < 4; second++ {
+		writer.WriteMetric(testMetric(second))
+	}
+
+	// Batches are sent before the run is over
+	deadline := time.Now().Add(5 * time.Second)
+	for receiver.requestCount(metricsPath) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := receiver.requestCount(metricsPath); count != 2 {
+		t.Fatalf("got %d metrics requests before Close, expected 2", count)
+	}
+
+	result := &Result{
+		CommandSamples: []collectors.Sample{{Name: "command_exit_code", Value: 3}},
+		Timestamp:      1704067205000,
+		Annotations:    []Annotation{{Time: 1704067201000, TimeEnd: 1704067201500, Text: "Command started", Tags: []string{"statexec", "start", "env=test"}}},
+	}
+	if err := writer.Close(result); err != nil {
+		t.Fatal(err)
+	}
+	if count := receiver.requestCount(metricsPath); count != 3 {
+		t.Errorf("got %d metrics requests, expected 3", count)
+	}
+
+	expectedResource := map[string]string{"service.name": "statexec", "service.instance.id": "host", "instance": "host", "job": "statexec", "role": "standalone", "env": "test"}
+	for key, value := range expectedResource {
+		if receiver.resource[key] != value {
+			t.Errorf("resource attribute %s is %q, expected %q", key, receiver.resource[key], value)
+		}
+	}
+	if receiver.scope != [2]string{"statexec", "1.2.3"} {
+		t.Errorf("unexpected scope %v", receiver.scope)
+	}
+
+	points := make(map[string][]otlpTestPoint)
+	for _, metric := range receiver.metrics {
+		points[metric.name] = append(points[metric.name], metric.points...)
+		switch metric.name {
+		case "statexec_cpu_seconds_total":
+			if !metric.sum || metric.temporality != otlpTemporalityCumulative || !metric.monotonic || metric.help != "CPU time" {
+				t.Errorf("counter not exported as a cumulative monotonic sum: %+v", metric)
+			}
+		case "statexec_command_status", "statexec_command_exit_code":
+			if metric.sum {
+				t.Errorf("gauge exported as a sum: %+v", metric)
+			}
+		}
+	}
+	cpu := points["statexec_cpu_seconds_total"]
+	if len(cpu) != 4 {
+		t.Fatalf("got %d cpu data points, expected 4", len(cpu))
+	}
+	for i, point := range cpu {
+		expectedTime := uint64(1704067200000+int64(i)*1000) * uint64(time.Millisecond)
+		if point.value != float64(i) || point.time != expectedTime || point.start != 1704067200000*uint64(time.Millisecond) {
+			t.Errorf("cpu data point %d is %+v", i, point)
+		}
+		if point.attributes["cpu"] != "0" || point.attributes["mode"] != "user" || len(point.attributes) != 2 {
+			t.Errorf("cpu data point %d has attributes %v", i, point.attributes)
+		}
+	}
+	if exitCode := points["statexec_command_exit_code"]; len(exitCode) != 1 || exitCode[0].value != 3 {
+		t.Errorf("unexpected exit code data points %+v", exitCode)
+	}
+	if len(points["statexec_command_status"]) != 4 || len(points["statexec_time_since_start_ms"]) != 4 {
+		t.Errorf("missing data points: %d command status, %d time since start", len(points["statexec_command_status"]), len(points["statexec_time_since_start_ms"]))
+	}
+
+	if count := receiver.requestCount(logsPath); count != 1 {
+		t.Fatalf("got %d logs requests, expected 1", count)
+	}
+	if len(receiver.logs) != 1 {
+		t.Fatalf("got %d log records, expected 1", len(receiver.logs))
+	}
+	log := receiver.logs[0]
+	if log.body != "Command started" || log.time != 1704067201000*uint64(time.Millisecond) || log.severity != otlpSeverityInfo {
+		t.Errorf("unexpected log record %+v", log)
+	}
+	if log.attributes["statexec.tags"] != "statexec,start" || log.attributes["statexec.duration_ms"] != "500" {
+		t.Errorf("unexpected log attributes %v", log.attributes)
+	}
+}
+
+func TestOtlpWriterHttp(t *testing.T) {
+	testOtlpExport(t, OtlpProtocolHttp, "/v1/metrics", "/v1/logs")
+}
+
+func TestOtlpWriterGrpc(t *testing.T) {
+	testOtlpExport(t, OtlpProtocolGrpc, otlpPaths[OtlpProtocolGrpc]["metrics"], otlpPaths[OtlpProtocolGrpc]["logs"])
+}
+
+func TestOtlpWriterRetries(t *testing.T) {
+	for _, test := range []struct {
+		protocol string
+		statuses []int
+		requests int
+		err      string
+	}{
+		{OtlpProtocolHttp, []int{http.StatusServiceUnavailable}, 2, ""},
+		{OtlpProtocolHttp, []int{http.StatusBadRequest}, 1, "400 Bad Request"},
+		// Unavailable is retried, invalid argument is not
+		{OtlpProtocolGrpc, []int{14}, 2, ""},
+		{OtlpProtocolGrpc, []int{3}, 1, "gRPC status 3: failing on purpose"},
+	} {
+		receiver := newOtlpReceiver(t, test.protocol == OtlpProtocolGrpc, test.statuses...)
+		writer := newTestOtlpWriter(receiver, test.protocol)
+		if err := writer.Start(testRunInfo()); err != nil {
+			t.Fatal(err)
+		}
+		writer.WriteMetric(testMetric(0))
+		err := writer.Close(&Result{})
+		path := otlpPaths[test.protocol]["metrics"]
+		if count := receiver.requestCount(path); count != test.requests {
+			t.Errorf("%s %v: got %d requests, expected %d", test.protocol, test.statuses, count, test.requests)
+		}
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s %v: unexpected error %v", test.protocol, test.statuses, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err) || !strings.Contains(err.Error(), "5 of 5 samples not sent")):
+			t.Errorf("%s %v: error %v, expected %q", test.protocol, test.statuses, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/blackswifthosting/statexec/collectors"
+	"github.com/blackswifthosting/statexec/promfile"
+)
+
+// PromWriter writes metrics in prometheus format as they are collected.
+// The file only ever contains complete lines, and stays valid if statexec
+// is killed. Once the run is over, it is rewritten in OpenMetrics, which
+// requires the samples of a family to be grouped.
+type PromWriter struct {
+	Version string // Version of statexec, written in the header
+	Config  string // Resolved configuration, written as comments in the header
+
+	path string
+	file *lineFile
+	info RunInfo
+}
+
+func NewPromWriter(path string) *PromWriter {
+	return &PromWriter{Version: "dev", path: path}
+}
+
+// Create the metrics file and write its header
+func (w *PromWriter) Start(info RunInfo) error {
+	file, err := createLineFile(w.path)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.info = info
+
+	urlSuffix := ""
+	if w.Version != "dev" {
+		urlSuffix = "tree/" + w.Version
+	}
+
+	header := `
+# Collector: blackswift/statexec
+# Version: ` + w.Version + `
+# Url: https://github.com/blackswifthosting/statexec/` + urlSuffix + `
+# Interval: ` + info.Interval.String() + `
+`
+	if w.Config != "" {
+		header += "# Config:\n" + commentLines(w.Config, "#   ")
+	}
+	header += "\n" + renderMetricDescs(info.Descs) + "\n"
+	err = w.file.write(header)
+	if err == nil {
+		err = w.file.flush()
+	}
+	if err != nil {
+		// Close is not called for a writer which failed to start
+		w.file.close()
+		return fmt.Errorf("writing metrics file header: %w", err)
+	}
+	return nil
+}
+
+// Prefix every line of a text, to embed it as comments
+func commentLines(text string, prefix string) string {
+	var builder strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		builder.WriteString(prefix + line + "\n")
+	}
+	return builder.String()
+}
+
+// Render a sample value, integers are written without decimals
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Render samples in prometheus format
+func (w *PromWriter) renderSamples(samples []collectors.Sample, timestamp int64) string {
+	var builder strings.Builder
+	for _, sample := range samples {
+		fmt.Fprintf(&builder, MetricPrefix+"%s{%s} %s %d\n", sample.Name, renderLabels(w.info, sample.Labels), formatValue(sample.Value), timestamp)
+	}
+	return builder.String()
+}
+
+// Render HELP and TYPE comments of metric families
+func renderMetricDescs(descs []collectors.MetricDesc) string {
+	var builder strings.Builder
+	for _, desc := range descs {
+		fmt.Fprintf(&builder, "# HELP %s%s %s\n", MetricPrefix, desc.Name, desc.Help)
+		fmt.Fprintf(&builder, "# TYPE %s%s %s\n", MetricPrefix, desc.Name, desc.Type)
+	}
+	return builder.String()
+}
+
+func (w *PromWriter) WriteMetric(metric InstantMetric) error {
+	return w.file.write(w.renderSamples(metricSamples(metric), metric.Timestamp))
+}
+
+// Append annotations, the command result and the summary, then rewrite the
+// file in OpenMetrics
+func (w *PromWriter) Close(result *Result) error {
+	// ====== Write annotations ======
+	var builder strings.Builder
+	builder.WriteString("\n")
+	for _, annotation := range result.Annotations {
+		annotationJson, err := json.Marshal(annotation)
+		if err != nil {
+			return fmt.Errorf("marshalling annotation: %w", err)
+		}
+		builder.WriteString("#grafana-annotation " + string(annotationJson) + "\n")
+	}
+
+	// ====== Write command result ======
+	if len(result.CommandSamples) > 0 {
+		builder.WriteString("\n# Result of the command\n")
+		builder.WriteString(w.renderSamples(result.CommandSamples, result.Timestamp))
+	}
+
+	// ====== Write summary ======
+	if len(result.Summary) > 0 {
+		builder.WriteString("\n# Summary of metrics while command was running\n")
+		builder.WriteString(w.renderSamples(result.Summary, result.Timestamp))
+	}
+
+	// The file is closed even if the write failed
+	err := w.file.write(builder.String())
+	if closeErr := w.file.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing to metrics file: %w", err)
+	}
+	if err := rewriteOpenMetrics(w.path); err != nil {
+		return fmt.Errorf("rewriting metrics file in OpenMetrics, it is kept as is: %w", err)
+	}
+	return nil
+}
+
+// Rewrite a metrics file in OpenMetrics, the file is replaced only once the
+// new one is complete. Samples are spooled to a temporary directory next to
+// the file rather than held in memory. Pipes and devices are left as streamed.
+func rewriteOpenMetrics(path string) error {
+	if stat, err := os.Stat(path); err != nil || !stat.Mode().IsRegular() {
+		return err
+	}
+	input, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	spool, err := os.MkdirTemp(filepath.Dir(path), filepath.Base(path)+".spool")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(spool)
+
+	temporaryPath := path + ".tmp"
+	file, err := os.Create(temporaryPath)
+	if err != nil {
+		return err
+	}
+	err = promfile.Rewrite(input, file, spool)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+	return os.Rename(temporaryPath, path)
+}
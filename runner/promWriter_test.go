@@ -0,0 +1,19 @@
+package runner
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// Writing the header to a full disk fails the start instead of the close
+func TestPromWriterReportsFullDisk(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	writer := NewPromWriter("/dev/full")
+	if err := writer.Start(testRunInfo()); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected no space left on device, got %v", err)
+	}
+}
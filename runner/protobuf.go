@@ -0,0 +1,35 @@
+package runner
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Minimal protobuf encoding, enough for the remote write and OTLP messages
+
+// Append a length-delimited field: bytes, string or embedded message
+func appendBytesField(buffer []byte, field uint64, value []byte) []byte {
+	buffer = binary.AppendUvarint(buffer, field<<3|2)
+	buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+func appendStringField(buffer []byte, field uint64, value string) []byte {
+	return appendBytesField(buffer, field, []byte(value))
+}
+
+// Append a varint field: int64, uint32, bool or enum
+func appendVarintField(buffer []byte, field uint64, value uint64) []byte {
+	buffer = binary.AppendUvarint(buffer, field<<3|0)
+	return binary.AppendUvarint(buffer, value)
+}
+
+// Append a 64-bit field: fixed64 or sfixed64
+func appendFixed64Field(buffer []byte, field uint64, value uint64) []byte {
+	buffer = binary.AppendUvarint(buffer, field<<3|1)
+	return binary.LittleEndian.AppendUint64(buffer, value)
+}
+
+func appendDoubleField(buffer []byte, field uint64, value float64) []byte {
+	return appendFixed64Field(buffer, field, math.Float64bits(value))
+}
@@ -0,0 +1,92 @@
+package runner
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// A decoded protobuf field: varint and 64-bit values in value, length-delimited ones in bytes
+type protoField struct {
+	number uint64
+	value  uint64
+	bytes  []byte
+}
+
+// Decode the fields of a message, as written by the append functions
+func decodeProto(t *testing.T, message []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			t.Fatalf("invalid field key")
+		}
+		message = message[n:]
+		field := protoField{number: key >> 3}
+		switch key & 7 {
+		case 0:
+			field.value, n = binary.Uvarint(message)
+			if n <= 0 {
+				t.Fatalf("invalid varint of field %d", field.number)
+			}
+			message = message[n:]
+		case 1:
+			if len(message) < 8 {
+				t.Fatalf("truncated 64-bit field %d", field.number)
+			}
+			field.value = binary.LittleEndian.Uint64(message)
+			message = message[8:]
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				t.Fatalf("truncated length-delimited field %d", field.number)
+			}
+			field.bytes = message[n : n+int(length)]
+			message = message[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", key&7, field.number)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// Fields of a message with a number
+func protoFields(fields []protoField, number uint64) []protoField {
+	var found []protoField
+	for _, field := range fields {
+		if field.number == number {
+			found = append(found, field)
+		}
+	}
+	return found
+}
+
+// String of a field, empty when missing
+func protoString(t *testing.T, message []byte, number uint64) string {
+	fields := protoFields(decodeProto(t, message), number)
+	if len(fields) == 0 {
+		return ""
+	}
+	return string(fields[0].bytes)
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	var message []byte
+	message = appendStringField(message, 1, "name")
+	message = appendVarintField(message, 2, 1704067200000)
+	message = appendDoubleField(message, 3, 1.5)
+	message = appendBytesField(message, 4, appendStringField(nil, 1, "nested"))
+
+	fields := decodeProto(t, message)
+	if len(fields) != 4 {
+		t.Fatalf("got %d fields, expected 4", len(fields))
+	}
+	if string(fields[0].bytes) != "name" || fields[1].value != 1704067200000 || math.Float64frombits(fields[2].value) != 1.5 {
+		t.Errorf("unexpected fields %+v", fields)
+	}
+	if nested := protoString(t, fields[3].bytes, 1); nested != "nested" {
+		t.Errorf("nested string is %q", nested)
+	}
+}
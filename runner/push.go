@@ -0,0 +1,136 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Attempts to push a request, waiting twice as long between each of them
+	pushAttempts int           = 5
+	pushBackoff  time.Duration = 1 * time.Second
+	// Requests waiting to be sent at most, later ones are dropped while the endpoint is slow
+	pushQueueSize int = 16
+)
+
+// Value of an Authorization header for basic authentication
+func basicAuth(username string, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// Post a request body, retrying on network errors, server errors and rate limiting
+func pushWithRetry(client *http.Client, url string, header http.Header, body []byte) error {
+	return withRetry(func() (bool, error) { return push(client, url, header, body) })
+}
+
+// Call a function until it succeeds or tells not to retry, with an exponential backoff
+func withRetry(attempt func() (bool, error)) error {
+	backoff := pushBackoff
+	var err error
+	for i := 1; i <= pushAttempts; i++ {
+		if i > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var retry bool
+		retry, err = attempt()
+		if err == nil || !retry {
+			break
+		}
+	}
+	return err
+}
+
+// Post a request body, tells whether it is worth retrying on error
+func push(client *http.Client, url string, header http.Header, body []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header = header.Clone()
+	request.Header.Set("User-Agent", "statexec")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 == 2 {
+		return false, nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	err = fmt.Errorf("%s: %s", response.Status, bytes.TrimSpace(message))
+	// Client errors other than rate limiting would fail again
+	return response.StatusCode/100 == 5 || response.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Requests sent one at a time in the background, in order, so that pushes
+// during the run never make the collections wait for the network
+type pushQueue struct {
+	send     func(body []byte) error
+	requests chan pushRequest
+	done     chan struct{}
+
+	mutex   sync.Mutex
+	err     error // Last error
+	samples int   // Samples pushed
+	failed  int   // Samples which could not be sent
+}
+
+type pushRequest struct {
+	body    []byte
+	samples int
+}
+
+func newPushQueue(send func(body []byte) error) *pushQueue {
+	q := &pushQueue{
+		send:     send,
+		requests: make(chan pushRequest, pushQueueSize),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(q.done)
+		for request := range q.requests {
+			if err := q.send(request.body); err != nil {
+				q.fail(request.samples, err)
+			}
+		}
+	}()
+	return q
+}
+
+func (q *pushQueue) fail(samples int, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.failed += samples
+	q.err = err
+}
+
+// Queue a request, dropped when the queue is full
+func (q *pushQueue) push(body []byte, samples int) {
+	q.mutex.Lock()
+	q.samples += samples
+	q.mutex.Unlock()
+	select {
+	case q.requests <- pushRequest{body: body, samples: samples}:
+	default:
+		q.fail(samples, fmt.Errorf("queue full, the endpoint is too slow"))
+	}
+}
+
+// Wait for the queued requests, the error tells how many samples were not sent
+func (q *pushQueue) close() error {
+	close(q.requests)
+	<-q.done
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.err != nil {
+		return fmt.Errorf("%d of %d samples not sent: %w", q.failed, q.samples, q.err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/blackswifthosting/statexec/collectors"
+	"github.com/golang/snappy"
+)
+
+const (
+	// Samples sent in a single remote write request at most
+	remoteWriteBatchSize int = 10000
+	// Samples are sent once they are this old at most
+	remoteWriteFlushInterval time.Duration = 30 * time.Second
+)
+
+// RemoteWriter pushes the samples of the run with their original timestamps
+// to a Prometheus remote write endpoint, in batches sent in the background
+// while the command runs so that it never waits for the network. Samples
+// which cannot be sent are reported by Close, the metrics file still has
+// them.
+type RemoteWriter struct {
+	Username      string // Basic authentication, when not empty
+	Password      string
+	BearerToken   string // Bearer authentication, when not empty
+	Client        *http.Client
+	BatchSize     int           // Samples per request at most (default: 10000)
+	FlushInterval time.Duration // Age of the oldest sample waiting to be sent at most (default: 30s)
+
+	url   string
+	info  RunInfo
+	queue *pushQueue
+
+	// Batch being filled
+	series  map[string]*remoteSeries
+	order   []string // Series keys in the order they were first seen
+	samples int
+	since   time.Time // When the first sample of the batch was added
+}
+
+// A series of the remote write protocol, labels sorted by name
+type remoteSeries struct {
+	labels  [][2]string
+	samples []remoteSample
+}
+
+type remoteSample struct {
+	value     float64
+	timestamp int64
+}
+
+func NewRemoteWriter(url string) *RemoteWriter {
+	return &RemoteWriter{
+		url:           url,
+		Client:        &http.Client{Timeout: 30 * time.Second},
+		BatchSize:     remoteWriteBatchSize,
+		FlushInterval: remoteWriteFlushInterval,
+	}
+}
+
+func (w *RemoteWriter) Start(info RunInfo) error {
+	w.info = info
+	w.series = make(map[string]*remoteSeries)
+	w.order = nil
+	w.samples = 0
+	w.queue = newPushQueue(w.send)
+	return nil
+}
+
+func (w *RemoteWriter) WriteMetric(metric InstantMetric) error {
+	w.add(metricSamples(metric), metric.Timestamp)
+	if w.samples > 0 && time.Since(w.since) >= w.FlushInterval {
+		w.flush()
+	}
+	return nil
+}
+
+// Add samples to the series of the batch, which is sent once full
+func (w *RemoteWriter) add(samples []collectors.Sample, timestamp int64) {
+	for _, sample := range samples {
+		labels := [][2]string{
+			{"__name__", MetricPrefix + sample.Name},
+			{"instance", w.info.Instance},
+			{"job", w.info.Job},
+			{"role", w.info.Role},
+		}
+		for key, value := range sample.Labels {
+			labels = append(labels, [2]string{key, value})
+		}
+		for key, value := range w.info.Labels {
+			labels = append(labels, [2]string{key, value})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+
+		var key bytes.Buffer
+		for _, label := range labels {
+			key.WriteString(label[0] + "\x00" + label[1] + "\x00")
+		}
+		series, ok := w.series[key.String()]
+		if !ok {
+			series = &remoteSeries{labels: labels}
+			w.series[key.String()] = series
+			w.order = append(w.order, key.String())
+		}
+		series.samples = append(series.samples, remoteSample{value: sample.Value, timestamp: timestamp})
+		if w.samples == 0 {
+			w.since = time.Now()
+		}
+		w.samples++
+		if w.samples >= w.BatchSize {
+			w.flush()
+		}
+	}
+}
+
+// Queue the batch as a write request, and start a new one
+func (w *RemoteWriter) flush() {
+	if w.samples == 0 {
+		return
+	}
+	batch := make([]*remoteSeries, 0, len(w.order))
+	for _, key := range w.order {
+		batch = append(batch, w.series[key])
+	}
+	w.queue.push(snappy.Encode(nil, encodeWriteRequest(batch)), w.samples)
+	w.series = make(map[string]*remoteSeries)
+	w.order = nil
+	w.samples = 0
+}
+
+// Send the last batch with the command samples and the summary, and wait
+// for the requests still queued
+func (w *RemoteWriter) Close(result *Result) error {
+	w.add(result.CommandSamples, result.Timestamp)
+	w.add(result.Summary, result.Timestamp)
+	w.flush()
+	if err := w.queue.close(); err != nil {
+		return fmt.Errorf("remote write to %s: %w", w.url, err)
+	}
+	return nil
+}
+
+// Send a write request, retrying on network and server errors
+func (w *RemoteWriter) send(body []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-protobuf")
+	header.Set("Content-Encoding", "snappy")
+	header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.BearerToken != "" {
+		header.Set("Authorization", "Bearer "+w.BearerToken)
+	} else if w.Username != "" {
+		header.Set("Authorization", basicAuth(w.Username, w.Password))
+	}
+
+	return pushWithRetry(w.Client, w.url, header, body)
+}
+
+// Encode a prometheus.WriteRequest protobuf message:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(batch []*remoteSeries) []byte {
+	var request []byte
+	for _, series := range batch {
+		var timeSeries []byte
+		for _, label := range series.labels {
+			var labelMessage []byte
+			labelMessage = appendStringField(labelMessage, 1, label[0])
+			labelMessage = appendStringField(labelMessage, 2, label[1])
+			timeSeries = appendBytesField(timeSeries, 1, labelMessage)
+		}
+		for _, sample := range series.samples {
+			var sampleMessage []byte
+			sampleMessage = appendDoubleField(sampleMessage, 1, sample.value)
+			sampleMessage = appendVarintField(sampleMessage, 2, uint64(sample.timestamp))
+			timeSeries = appendBytesField(timeSeries, 2, sampleMessage)
+		}
+		request = appendBytesField(request, 1, timeSeries)
+	}
+	return request
+}
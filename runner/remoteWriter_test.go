@@ -0,0 +1,218 @@
+package runner
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blackswifthosting/statexec/collectors"
+	"github.com/golang/snappy"
+)
+
+type remoteWriteSample struct {
+	value     float64
+	timestamp int64
+}
+
+// Local remote write receiver, decoding the requests into samples by series
+type remoteWriteReceiver struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests int
+	statuses []int // Status of each request, 204 once they are used up
+	series   map[string][]remoteWriteSample
+	labels   map[string]map[string]string
+}
+
+func newRemoteWriteReceiver(t *testing.T, statuses ...int) *remoteWriteReceiver {
+	receiver := &remoteWriteReceiver{
+		statuses: statuses,
+		series:   make(map[string][]remoteWriteSample),
+		labels:   make(map[string]map[string]string),
+	}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		receiver.mutex.Lock()
+		defer receiver.mutex.Unlock()
+		receiver.requests++
+		if len(receiver.statuses) > 0 {
+			status := receiver.statuses[0]
+			receiver.statuses = receiver.statuses[1:]
+			if status/100 != 2 {
+				http.Error(response, "failing on purpose", status)
+				return
+			}
+		}
+
+		if request.Header.Get("Content-Encoding") != "snappy" || request.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected headers %v", request.Header)
+		}
+		if request.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected Authorization %q", request.Header.Get("Authorization"))
+		}
+		compressed, _ := io.ReadAll(request.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("decoding snappy: %v", err)
+			return
+		}
+		for _, timeSeries := range protoFields(decodeProto(t, body), 1) {
+			fields := decodeProto(t, timeSeries.bytes)
+			labels := make(map[string]string)
+			var key []string
+			for _, label := range protoFields(fields, 1) {
+				name, value := protoString(t, label.bytes, 1), protoString(t, label.bytes, 2)
+				labels[name] = value
+				key = append(key, name+"="+value)
+			}
+			for i := 1; i < len(key); i++ {
+				if key[i-1] > key[i] {
+					t.Errorf("labels not sorted: %v", key)
+				}
+			}
+			for _, sample := range protoFields(fields, 2) {
+				sampleFields := decodeProto(t, sample.bytes)
+				receiver.series[strings.Join(key, ",")] = append(receiver.series[strings.Join(key, ",")], remoteWriteSample{
+					value:     math.Float64frombits(protoFields(sampleFields, 1)[0].value),
+					timestamp: int64(protoFields(sampleFields, 2)[0].value),
+				})
+			}
+			receiver.labels[strings.Join(key, ",")] = labels
+		}
+		response.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (r *remoteWriteReceiver) requestCount() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.requests
+}
+
+func testRunInfo() RunInfo {
+	return RunInfo{Job: "statexec", Instance: "host", Role: "standalone", Labels: map[string]string{"env": "test"}, Interval: time.Second, StartTime: 1704067200000}
+}
+
+// A collection with a CPU sample, at a second from the start
+func testMetric(second int64) InstantMetric {
+	return InstantMetric{
+		CommandStatus: CommandStatusRunning,
+		Samples:       []collectors.Sample{{Name: "cpu_seconds_total", Labels: map[string]string{"cpu": "0", "mode": "user"}, Value: float64(second)}},
+		MsSinceStart:  second * 1000,
+		Timestamp:     1704067200000 + second*1000,
+	}
+}
+
+func TestRemoteWriterSendsBatchesWhileRunning(t *testing.T) {
+	receiver := newRemoteWriteReceiver(t)
+	writer := NewRemoteWriter(receiver.URL)
+	writer.BearerToken = "token"
+	// A collection has 5 samples, a batch is sent every 2 collections
+	writer.BatchSize = 10
+	if err := writer.Start(testRunInfo()); err != nil {
+		t.Fatal(err)
+	}
+	for second := int64(0); second < 4; second++ {
+		writer.WriteMetric(testMetric(second))
+	}
+
+	// Batches are sent before the run is over
+	deadline := time.Now().Add(5 * time.Second)
+	for receiver.requestCount() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := receiver.requestCount(); count != 2 {
+		t.Fatalf("got %d requests before Close, expected 2", count)
+	}
+
+	result := &Result{
+		CommandSamples: []collectors.Sample{{Name: "command_exit_code", Value: 3}},
+		Timestamp:      1704067205000,
+	}
+	if err := writer.Close(result); err != nil {
+		t.Fatal(err)
+	}
+	if count := receiver.requestCount(); count != 3 {
+		t.Errorf("got %d requests, expected 3", count)
+	}
+
+	cpuKey := "__name__=statexec_cpu_seconds_total,cpu=0,env=test,instance=host,job=statexec,mode=user,role=standalone"
+	cpu := receiver.series[cpuKey]
+	if len(cpu) != 4 {
+		t.Fatalf("got %d samples of %s, expected 4 (series: %v)", len(cpu), cpuKey, receiver.labels)
+	}
+	for i, sample := range cpu {
+		if sample.value != float64(i) || sample.timestamp != 1704067200000+int64(i)*1000 {
+			t.Errorf("sample %d of %s is %+v", i, cpuKey, sample)
+		}
+	}
+	exitCode := receiver.series["__name__=statexec_command_exit_code,env=test,instance=host,job=statexec,role=standalone"]
+	if len(exitCode) != 1 || exitCode[0].value != 3 || exitCode[0].timestamp != 1704067205000 {
+		t.Errorf("unexpected exit code samples %+v", exitCode)
+	}
+	// command_status, command_timed_out, cpu, time_since_start_ms, metric_collect_duration_ms and command_exit_code
+	if len(receiver.series) != 6 {
+		t.Errorf("got %d series, expected 6: %v", len(receiver.series), receiver.labels)
+	}
+}
+
+func TestRemoteWriterRetriesServerErrors(t *testing.T) {
+	receiver := newRemoteWriteReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	writer := NewRemoteWriter(receiver.URL)
+	writer.BearerToken = "token"
+	writer.Start(testRunInfo())
+	writer.WriteMetric(testMetric(0))
+
+	started := time.Now()
+	if err := writer.Close(&Result{}); err != nil {
+		t.Fatal(err)
+	}
+	// Waiting 1s then 2s between the attempts
+	if elapsed := time.Since(started); elapsed < 3*time.Second {
+		t.Errorf("retried after %s, expected a backoff of 3s", elapsed)
+	}
+	if count := receiver.requestCount(); count != 3 {
+		t.Errorf("got %d requests, expected 3", count)
+	}
+	if len(receiver.series) != 5 {
+		t.Errorf("got %d series, expected 5", len(receiver.series))
+	}
+}
+
+func TestRemoteWriterDoesNotRetryClientErrors(t *testing.T) {
+	receiver := newRemoteWriteReceiver(t, http.StatusBadRequest)
+	writer := NewRemoteWriter(receiver.URL)
+	writer.BearerToken = "token"
+	writer.Start(testRunInfo())
+	writer.WriteMetric(testMetric(0))
+
+	err := writer.Close(&Result{})
+	if err == nil || !strings.Contains(err.Error(), "5 of 5 samples not sent") || !strings.Contains(err.Error(), "400") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if count := receiver.requestCount(); count != 1 {
+		t.Errorf("got %d requests, expected 1", count)
+	}
+}
+
+func TestRemoteWriterFlushesOldSamples(t *testing.T) {
+	receiver := newRemoteWriteReceiver(t)
+	writer := NewRemoteWriter(receiver.URL)
+	writer.BearerToken = "token"
+	writer.FlushInterval = time.Nanosecond
+	writer.Start(testRunInfo())
+	writer.WriteMetric(testMetric(0))
+	writer.WriteMetric(testMetric(1))
+	if err := writer.Close(&Result{}); err != nil {
+		t.Fatal(err)
+	}
+	if count := receiver.requestCount(); count != 2 {
+		t.Errorf("got %d requests, expected one per collection", count)
+	}
+}
@@ -0,0 +1,574 @@
+// Package runner runs a command while collecting system metrics, and hands
+// them to pluggable writers. Each Runner holds its own state, so that several
+// commands can be measured at once in the same process.
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/blackswifthosting/statexec/collectors"
+)
+
+const (
+	MetricPrefix string = "statexec_"
+
+	CommandStatusPending int = 0
+	CommandStatusRunning int = 1
+	CommandStatusDone    int = 2
+)
+
+type Options struct {
+	Job      string            // Value of the job label (default: statexec)
+	Instance string            // Value of the instance label (default: the command name)
+	Role     string            // Value of the role label (default: standalone)
+	Labels   map[string]string // Extra labels added to every sample
+
+	MetricsStartTime int64         // Timestamp of the start in milliseconds, 0 for the real start time
+	Interval         time.Duration // Interval between two collections (default: 1s)
+	Collectors       string        // Enabled collectors, see collectors.Registry.Configure (default: all)
+
+	DelayBeforeCommand time.Duration // Metrics are collected while waiting
+	DelayAfterCommand  time.Duration
+
+	CommandTimeout time.Duration  // The command is stopped after this duration, 0 to disable
+	TimeoutSignal  syscall.Signal // Sent to the command process group on timeout (default: SIGTERM)
+	KillAfter      time.Duration  // Time given after TimeoutSignal before SIGKILL (default: 10s, also when 0)
+
+	// Catch SIGINT, SIGTERM, SIGHUP and SIGQUIT sent to the process: SIGINT is
+	// forwarded to the command while it runs, otherwise it interrupts the run
+	// as the others do. Meant for CLIs, embedders can cancel the context
+	// given to Run instead.
+	HandleSignals bool
+	ForwardSignal syscall.Signal // Sent to the command when interrupted, 0 for the received signal (SIGTERM on cancellation)
+	GracePeriod   time.Duration  // Time given to the command to stop before SIGKILL (default: 10s, also when 0)
+
+	Writers []Writer
+}
+
+// Default options, as used by the statexec command line
+func DefaultOptions() Options {
+	return Options{
+		Job:           "statexec",
+		Role:          "standalone",
+		Labels:        make(map[string]string),
+		Interval:      1 * time.Second,
+		TimeoutSignal: syscall.SIGTERM,
+		KillAfter:     10 * time.Second,
+		GracePeriod:   10 * time.Second,
+	}
+}
+
+// Metrics of a single collection
+type InstantMetric struct {
+	CommandStatus   int
+	TimedOut        bool
+	Samples         []collectors.Sample
+	MsSinceStart    int64
+	CollectDuration int64 // In milliseconds
+	Timestamp       int64 // In milliseconds
+}
+
+// Event of the run, in the Grafana annotations format
+type Annotation struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd"`
+	Text    string   `json:"text"`
+	Tags    []string `json:"tags"`
+}
+
+type Result struct {
+	ExitCode    int  // Exit code of the command, 128+signal when killed by a signal
+	Started     bool // False when the run was interrupted or the command could not start
+	TimedOut    bool
+	Interrupted bool
+	Duration    time.Duration
+	Rusage      *syscall.Rusage // Resource usage of the command, nil if not available
+
+	Annotations    []Annotation
+	CommandSamples []collectors.Sample // Exit code, duration and resource usage of the command
+	Summary        []collectors.Sample // Summary of metrics while the command was running
+	Timestamp      int64               // Timestamp of the command samples and summary, in milliseconds
+}
+
+// Metric families written by statexec itself, before the collectors ones
+var commandMetricDescs = []collectors.MetricDesc{
+	{Name: "command_status", Help: "Status of the command (0: pending, 1: running, 2: done)", Type: collectors.TypeGauge},
+	{Name: "command_timed_out", Help: "Whether the command was stopped by the command timeout (0: no, 1: yes)", Type: collectors.TypeGauge},
+	{Name: "command_exit_code", Help: "Exit code of the command, 128+signal when killed by a signal", Type: collectors.TypeGauge},
+	{Name: "command_duration_seconds", Help: "Duration of the command execution in seconds", Type: collectors.TypeGauge},
+}
+
+// Metric families written by statexec itself, after the collectors ones
+var selfMonitoringMetricDescs = []collectors.MetricDesc{
+	{Name: "time_since_start_ms", Help: "Milliseconds since monitoring start, sampled every collection interval", Type: collectors.TypeGauge},
+	{Name: "metric_collect_duration_ms", Help: "Duration of the metric collection in milliseconds", Type: collectors.TypeGauge},
+}
+
+type Runner struct {
+	options          Options
+	registry         *collectors.Registry
+	processCollector *collectors.ProcessCollector
+
+	// Collections are serialized so that metrics are written in time order,
+	// mutex also protects the state below
+	mutex          sync.Mutex
+	info           RunInfo
+	realStartTime  time.Time
+	commandState   int
+	timedOut       bool
+	annotations    []Annotation
+	summary        *runSummary
+	commandSamples []collectors.Sample
+	writeErr       error
+}
+
+// Build the registry of collectors enabled by a selection
+func newRegistry(selection string) (*collectors.Registry, *collectors.ProcessCollector, error) {
+	processCollector := collectors.NewProcessCollector()
+	registry := collectors.NewRegistry(
+		collectors.NewCpuCollector(),
+		collectors.NewMemoryCollector(),
+		collectors.NewNetworkCollector(),
+		collectors.NewDiskCollector(),
+		processCollector,
+	)
+	if selection != "" {
+		if err := registry.Configure(selection); err != nil {
+			return nil, nil, err
+		}
+	}
+	return registry, processCollector, nil
+}
+
+// Names of the collectors enabled by a selection, all of them when empty
+func CollectorNames(selection string) ([]string, error) {
+	registry, _, err := newRegistry(selection)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, collector := range registry.Enabled() {
+		names = append(names, collector.Name())
+	}
+	return names, nil
+}
+
+func New(options Options) (*Runner, error) {
+	defaults := DefaultOptions()
+	if options.Job == "" {
+		options.Job = defaults.Job
+	}
+	if options.Role == "" {
+		options.Role = defaults.Role
+	}
+	if options.Interval <= 0 {
+		options.Interval = defaults.Interval
+	}
+	if options.TimeoutSignal == 0 {
+		options.TimeoutSignal = defaults.TimeoutSignal
+	}
+	if options.KillAfter <= 0 {
+		options.KillAfter = defaults.KillAfter
+	}
+	if options.GracePeriod <= 0 {
+		options.GracePeriod = defaults.GracePeriod
+	}
+
+	registry, processCollector, err := newRegistry(options.Collectors)
+	if err != nil {
+		return nil, err
+	}
+	return &Runner{
+		options:          options,
+		registry:         registry,
+		processCollector: processCollector,
+	}, nil
+}
+
+// Run the command while collecting metrics, until the command is done and
+// the delay after it is over. Canceling ctx interrupts the run as a
+// termination signal would. The error reports a command which could not be
+// started or a failing writer, the result is filled in any case.
+func (r *Runner) Run(ctx context.Context, cmd *exec.Cmd) (Result, error) {
+	var result Result
+	var wg sync.WaitGroup
+
+	r.realStartTime = time.Now()
+	r.commandState = CommandStatusPending
+	r.timedOut = false
+	r.annotations = nil
+	r.commandSamples = nil
+	r.writeErr = nil
+	r.summary = newRunSummary()
+
+	r.info = RunInfo{
+		Job:       r.options.Job,
+		Instance:  r.options.Instance,
+		Role:      r.options.Role,
+		Labels:    r.options.Labels,
+		Interval:  r.options.Interval,
+		StartTime: r.options.MetricsStartTime,
+		Command:   cmd.Args,
+	}
+	if r.info.Instance == "" && len(cmd.Args) > 0 {
+		r.info.Instance = cmd.Args[0]
+	}
+	if r.info.StartTime == 0 {
+		r.info.StartTime = r.realStartTime.UnixMilli()
+	}
+	r.info.Descs = append(r.info.Descs, commandMetricDescs...)
+	r.info.Descs = append(r.info.Descs, r.registry.Describe()...)
+	r.info.Descs = append(r.info.Descs, selfMonitoringMetricDescs...)
+	r.info.Descs = append(r.info.Descs, rusageMetricDescs...)
+	r.info.Descs = append(r.info.Descs, summaryMetricDescs...)
+
+	for i, writer := range r.options.Writers {
+		if err := writer.Start(r.info); err != nil {
+			// Writers already started may run exporters in the background
+			errs := []error{fmt.Errorf("starting writer: %w", err)}
+			for j := i - 1; j >= 0; j-- {
+				errs = append(errs, r.options.Writers[j].Close(&result))
+			}
+			return result, errors.Join(errs...)
+		}
+	}
+
+	// Channel to signal when to stop gathering metrics
+	quit := make(chan struct{})
+	defer close(quit)
+
+	// Start gathering metrics in a goroutine we will wait for
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.collectLoop(quit)
+	}()
+
+	// Protects the command start against signals received meanwhile. It is
+	// taken before r.mutex when both are needed, never after.
+	var processMutex sync.Mutex
+	var commandStarted = false
+	var commandFinished = false
+
+	// Send a signal to the command, then SIGKILL if it is still running after
+	// killDelay. processMutex must be held.
+	terminateCommand := func(sig syscall.Signal, killDelay time.Duration) {
+		_ = signalCommand(cmd, sig)
+		time.AfterFunc(killDelay, func() {
+			processMutex.Lock()
+			defer processMutex.Unlock()
+			if !commandFinished {
+				r.annotate(r.msSinceStart(), "Command still running "+killDelay.String()+" after "+SignalName(sig)+", sending SIGKILL", "killed")
+				_ = signalCommand(cmd, syscall.SIGKILL)
+			}
+		})
+	}
+
+	// Closed when the run is interrupted
+	interrupted := make(chan struct{})
+	var interruptOnce sync.Once
+	var interruptSignal syscall.Signal
+
+	// Signal which interrupted the run, 0 if none
+	interruptedBy := func() syscall.Signal {
+		processMutex.Lock()
+		defer processMutex.Unlock()
+		return interruptSignal
+	}
+
+	// Interrupt the run: skip delays, and stop the command if it is running
+	interrupt := func(sig syscall.Signal, reason string) {
+		processMutex.Lock()
+		defer processMutex.Unlock()
+
+		interruptOnce.Do(func() {
+			interruptSignal = sig
+			close(interrupted)
+			r.annotate(r.msSinceStart(), "Interrupted by "+reason, "interrupted")
+		})
+
+		if commandStarted && !commandFinished {
+			sigToForward := sig
+			if r.options.ForwardSignal != 0 {
+				sigToForward = r.options.ForwardSignal
+			}
+			terminateCommand(sigToForward, r.options.GracePeriod)
+		}
+	}
+
+	// Catch signals: SIGINT is forwarded to the child process while it runs,
+	// otherwise it interrupts the run as termination signals (e.g. a
+	// Kubernetes pod eviction) do, stopping the command so that metrics are
+	// still written
+	if r.options.HandleSignals {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+		defer signal.Stop(sigs)
+
+		go func() {
+			for received := range sigs {
+				sig := received.(syscall.Signal)
+				if sig == syscall.SIGINT {
+					processMutex.Lock()
+					running := commandStarted && !commandFinished
+					if running {
+						// The whole process group when the command runs in its own,
+						// as it does not receive the Ctrl+C of the terminal then
+						_ = signalCommand(cmd, sig)
+					}
+					processMutex.Unlock()
+					if running {
+						continue
+					}
+				}
+				interrupt(sig, SignalName(sig))
+			}
+		}()
+	}
+
+	// Stop the run when the context is canceled
+	runDone := make(chan struct{})
+	defer close(runDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			interrupt(syscall.SIGTERM, "context: "+ctx.Err().Error())
+		case <-runDone:
+		}
+	}()
+
+	// Wait before starting the command
+	if r.options.DelayBeforeCommand > 0 {
+		select {
+		case <-time.After(r.options.DelayBeforeCommand):
+		case <-interrupted:
+		}
+	}
+
+	// Start the command, unless the run was interrupted during the delay
+	var startErr error
+	processMutex.Lock()
+	select {
+	case <-interrupted:
+	default:
+		if r.options.CommandTimeout > 0 {
+			// Run the command in its own process group to signal all its children on timeout
+			if cmd.SysProcAttr == nil {
+				cmd.SysProcAttr = &syscall.SysProcAttr{}
+			}
+			cmd.SysProcAttr.Setpgid = true
+		}
+
+		startErr = cmd.Start()
+		if startErr != nil {
+			// Same exit codes as shells for a missing or non executable command
+			result.ExitCode = 126
+			if errors.Is(startErr, exec.ErrNotFound) || errors.Is(startErr, fs.ErrNotExist) {
+				result.ExitCode = 127
+			}
+			r.annotate(r.msSinceStart(), "Command failed to start: "+startErr.Error(), "failed")
+			break
+		}
+		commandStarted = true
+		r.processCollector.Follow(int32(cmd.Process.Pid))
+
+		// Stop the command on timeout, escalating to SIGKILL
+		if r.options.CommandTimeout > 0 {
+			time.AfterFunc(r.options.CommandTimeout, func() {
+				processMutex.Lock()
+				defer processMutex.Unlock()
+				if commandFinished {
+					return
+				}
+				r.mutex.Lock()
+				r.timedOut = true
+				r.mutex.Unlock()
+				r.annotate(r.msSinceStart(), "Command timed out after "+r.options.CommandTimeout.String()+", sending "+SignalName(r.options.TimeoutSignal), "timeout")
+				terminateCommand(r.options.TimeoutSignal, r.options.KillAfter)
+			})
+		}
+	}
+	processMutex.Unlock()
+
+	if commandStarted {
+		r.setCommandState(CommandStatusRunning)
+		commandStartedAtTime := r.collect()
+
+		// Annotate the command start
+		r.annotate(commandStartedAtTime, "Command started", "start")
+
+		// Wait for the command to finish
+		_ = cmd.Wait()
+
+		processMutex.Lock()
+		commandFinished = true
+		r.mutex.Lock()
+		timedOut := r.timedOut
+		r.mutex.Unlock()
+		// Children left behind by a timed out command are killed with its process group
+		if timedOut {
+			_ = signalCommand(cmd, syscall.SIGKILL)
+		}
+		processMutex.Unlock()
+
+		r.processCollector.Follow(0)
+		r.setCommandState(CommandStatusDone)
+		commandFinishedAtTime := r.collect()
+		result.ExitCode = commandExitCode(cmd.ProcessState)
+		result.Duration = time.Duration(commandFinishedAtTime-commandStartedAtTime) * time.Millisecond
+		result.Rusage = rusageOf(cmd.ProcessState)
+
+		// Annotate the command end
+		doneText := "Command done with status " + strconv.Itoa(result.ExitCode)
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			doneText += " (killed by " + SignalName(status.Signal()) + ")"
+		}
+		if result.Rusage != nil {
+			doneText += "\n" + rusageText(result.Rusage)
+		}
+		r.annotate(commandFinishedAtTime, doneText, "done")
+
+		r.mutex.Lock()
+		r.commandSamples = []collectors.Sample{
+			{Name: "command_exit_code", Value: float64(result.ExitCode)},
+			{Name: "command_duration_seconds", Value: result.Duration.Seconds()},
+		}
+		r.commandSamples = append(r.commandSamples, rusageSamples(result.Rusage)...)
+		r.mutex.Unlock()
+	} else if sig := interruptedBy(); sig != 0 {
+		// Interrupted before the command could start
+		result.ExitCode = 128 + int(sig)
+	}
+
+	// Wait after the command
+	if r.options.DelayAfterCommand > 0 && startErr == nil {
+		select {
+		case <-time.After(r.options.DelayAfterCommand):
+		case <-interrupted:
+		}
+	}
+
+	// Signal to stop gathering metrics, and wait for the last collection
+	quit <- struct{}{}
+	wg.Wait()
+
+	result.Interrupted = interruptedBy() != 0
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	result.Started = commandStarted
+	result.TimedOut = r.timedOut
+	result.Annotations = r.annotations
+	result.CommandSamples = r.commandSamples
+	result.Summary = r.summary.compute()
+	result.Timestamp = r.summary.timestamp()
+	if result.Timestamp == 0 {
+		result.Timestamp = r.info.StartTime + r.msSinceStart()
+	}
+
+	errs := []error{startErr, r.writeErr}
+	for _, writer := range r.options.Writers {
+		errs = append(errs, writer.Close(&result))
+	}
+	if startErr != nil {
+		return result, fmt.Errorf("starting command: %w", startErr)
+	}
+	return result, errors.Join(errs...)
+}
+
+// Exit code of a finished command, 128+signal when it was killed by a signal
+func commandExitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+func (r *Runner) msSinceStart() int64 {
+	return time.Since(r.realStartTime).Milliseconds()
+}
+
+func (r *Runner) setCommandState(state int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.commandState = state
+}
+
+// Add an annotation at msSinceStart
+func (r *Runner) annotate(msSinceStart int64, text string, tag string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	timestamp := r.info.StartTime + msSinceStart
+	r.annotations = append(r.annotations, Annotation{
+		Time:    timestamp,
+		TimeEnd: timestamp,
+		Text:    text,
+		Tags: []string{
+			"statexec",
+			tag,
+			"instance=" + r.info.Instance,
+			"job=" + r.info.Job,
+			"role=" + r.info.Role,
+		},
+	})
+}
+
+// Collect metrics every interval until quit, then once more. Timestamps
+// are based on the real time elapsed since the start as ticks may be late
+// or dropped.
+func (r *Runner) collectLoop(quit chan struct{}) {
+	ticker := time.NewTicker(r.options.Interval)
+	defer ticker.Stop()
+
+	r.collect()
+
+	stopGatheringNextIteration := false
+	for {
+		select {
+		case <-ticker.C:
+			r.collect()
+			if stopGatheringNextIteration {
+				return
+			}
+		case <-quit:
+			stopGatheringNextIteration = true
+		}
+	}
+}
+
+// Gather metrics and hand them to the writers, returns the collection time
+// in milliseconds since the start
+func (r *Runner) collect() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	timeBeforeGathering := time.Now()
+	msSinceStart := timeBeforeGathering.Sub(r.realStartTime).Milliseconds()
+
+	metric := InstantMetric{
+		CommandStatus: r.commandState,
+		TimedOut:      r.timedOut,
+		Samples:       r.registry.Collect(),
+		MsSinceStart:  msSinceStart,
+		Timestamp:     r.info.StartTime + msSinceStart,
+	}
+	metric.CollectDuration = time.Since(timeBeforeGathering).Milliseconds()
+
+	r.summary.observe(metric)
+	for _, writer := range r.options.Writers {
+		if err := writer.WriteMetric(metric); err != nil && r.writeErr == nil {
+			r.writeErr = err
+		}
+	}
+	return msSinceStart
+}
@@ -0,0 +1,140 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Options of a short run, collecting cpu and memory metrics in memory
+func testOptions(writers ...Writer) Options {
+	options := DefaultOptions()
+	options.Interval = 100 * time.Millisecond
+	options.Collectors = "cpu,memory"
+	options.Writers = writers
+	return options
+}
+
+func testRun(t *testing.T, ctx context.Context, options Options, args ...string) (Result, error) {
+	t.Helper()
+	runner, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runner.Run(ctx, exec.Command(args[0], args[1:]...))
+}
+
+// Kinds of the annotations of a run, e.g. start, in order
+func annotationKinds(annotations []Annotation) []string {
+	var tags []string
+	for _, annotation := range annotations {
+		tags = append(tags, annotation.Tags[1])
+	}
+	return tags
+}
+
+func TestRunCollectsWhileCommandRuns(t *testing.T) {
+	writer := &MemoryWriter{}
+	result, err := testRun(t, context.Background(), testOptions(writer), "sh", "-c", "sleep 0.5; exit 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Started || result.ExitCode != 3 || result.Interrupted || result.TimedOut {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if tags := annotationKinds(result.Annotations); !slices.Equal(tags, []string{"start", "done"}) {
+		t.Fatalf("annotations of kinds %v, expected start then done", tags)
+	}
+	if writer.Result == nil || writer.Result.ExitCode != 3 {
+		t.Fatalf("writer closed with %+v", writer.Result)
+	}
+	if writer.Info.Instance != "sh" {
+		t.Fatalf("instance %q, expected the command name", writer.Info.Instance)
+	}
+
+	running := 0
+	for i, metric := range writer.Metrics {
+		if i > 0 && metric.Timestamp < writer.Metrics[i-1].Timestamp {
+			t.Fatalf("metrics are not in time order: %d after %d", metric.Timestamp, writer.Metrics[i-1].Timestamp)
+		}
+		if metric.CommandStatus == CommandStatusRunning {
+			running++
+		}
+	}
+	if running < 2 {
+		t.Fatalf("%d collections while the command runs, expected a few", running)
+	}
+	if last := writer.Metrics[len(writer.Metrics)-1]; last.CommandStatus != CommandStatusDone {
+		t.Fatalf("last collection with status %d, expected done", last.CommandStatus)
+	}
+}
+
+func TestRunMissingCommand(t *testing.T) {
+	writer := &MemoryWriter{}
+	result, err := testRun(t, context.Background(), testOptions(writer), "statexec-test-missing-command")
+	if err == nil || !strings.Contains(err.Error(), "starting command") {
+		t.Fatalf("expected an error starting the command, got %v", err)
+	}
+	if result.Started || result.ExitCode != 127 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if tags := annotationKinds(result.Annotations); !slices.Equal(tags, []string{"failed"}) {
+		t.Fatalf("annotations of kinds %v, expected failed", tags)
+	}
+	if writer.Result == nil {
+		t.Fatal("writer not closed")
+	}
+}
+
+// Canceling the context before the command starts ends the run as SIGTERM
+func TestRunInterruptedBeforeCommand(t *testing.T) {
+	writer := &MemoryWriter{}
+	options := testOptions(writer)
+	options.DelayBeforeCommand = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	result, err := testRun(t, ctx, options, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(started) > 10*time.Second {
+		t.Fatal("the delay before the command was not skipped")
+	}
+	if result.Started || !result.Interrupted || result.ExitCode != 143 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if tags := annotationKinds(result.Annotations); !slices.Equal(tags, []string{"interrupted"}) {
+		t.Fatalf("annotations of kinds %v, expected interrupted", tags)
+	}
+}
+
+// Writer failing to start
+type failingWriter struct {
+	MemoryWriter
+}
+
+func (w *failingWriter) Start(info RunInfo) error {
+	return errors.New("no space left on device")
+}
+
+// Writers started before a failing one are closed, later ones are not started
+func TestRunClosesStartedWritersWhenStartFails(t *testing.T) {
+	started := &MemoryWriter{}
+	failing := &failingWriter{}
+	notStarted := &MemoryWriter{}
+	_, err := testRun(t, context.Background(), testOptions(started, failing, notStarted), "true")
+	if err == nil || !strings.Contains(err.Error(), "no space left on device") {
+		t.Fatalf("expected the writer error, got %v", err)
+	}
+	if started.Result == nil {
+		t.Fatal("writer started before the failing one is not closed")
+	}
+	if failing.Result != nil || notStarted.Result != nil {
+		t.Fatal("writers not started are closed")
+	}
+}
@@ -0,0 +1,81 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/blackswifthosting/statexec/collectors"
+)
+
+// Resource usage of the command and its reaped descendants, as reported by wait4
+var rusageMetricDescs = []collectors.MetricDesc{
+	{Name: "command_rusage_cpu_seconds_total", Help: "CPU time used by the command and its reaped descendants in seconds", Type: collectors.TypeCounter},
+	{Name: "command_rusage_maxrss_bytes", Help: "ru_maxrss of the command in bytes, an upper bound of its peak resident memory as it includes the resident memory of statexec when starting it", Type: collectors.TypeGauge},
+	{Name: "command_rusage_page_faults_total", Help: "Page faults of the command and its reaped descendants (minor: no I/O, major: I/O)", Type: collectors.TypeCounter},
+	{Name: "command_rusage_block_operations_total", Help: "Block input and output operations of the command and its reaped descendants", Type: collectors.TypeCounter},
+	{Name: "command_rusage_context_switches_total", Help: "Context switches of the command and its reaped descendants", Type: collectors.TypeCounter},
+}
+
+// Resource usage of a finished command, nil when the platform does not report it
+func rusageOf(state *os.ProcessState) *syscall.Rusage {
+	if state == nil {
+		return nil
+	}
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return nil
+	}
+	return rusage
+}
+
+// ru_maxrss in bytes, Linux reports it in kilobytes. Commands are started
+// with vfork, so the kernel counts the resident memory of statexec at the
+// time in ru_maxrss of the command: it is not the peak of the command alone.
+func rusageMaxrssBytes(rusage *syscall.Rusage) float64 {
+	if runtime.GOOS == "darwin" {
+		return float64(rusage.Maxrss)
+	}
+	return float64(rusage.Maxrss) * 1024
+}
+
+func timevalSeconds(tv syscall.Timeval) float64 {
+	return float64(time.Duration(tv.Nano())) / float64(time.Second)
+}
+
+// Samples of the resource usage of a finished command
+func rusageSamples(rusage *syscall.Rusage) []collectors.Sample {
+	if rusage == nil {
+		return nil
+	}
+	return []collectors.Sample{
+		{Name: "command_rusage_cpu_seconds_total", Labels: map[string]string{"mode": "user"}, Value: timevalSeconds(rusage.Utime)},
+		{Name: "command_rusage_cpu_seconds_total", Labels: map[string]string{"mode": "system"}, Value: timevalSeconds(rusage.Stime)},
+		{Name: "command_rusage_maxrss_bytes", Value: rusageMaxrssBytes(rusage)},
+		{Name: "command_rusage_page_faults_total", Labels: map[string]string{"type": "minor"}, Value: float64(rusage.Minflt)},
+		{Name: "command_rusage_page_faults_total", Labels: map[string]string{"type": "major"}, Value: float64(rusage.Majflt)},
+		{Name: "command_rusage_block_operations_total", Labels: map[string]string{"type": "input"}, Value: float64(rusage.Inblock)},
+		{Name: "command_rusage_block_operations_total", Labels: map[string]string{"type": "output"}, Value: float64(rusage.Oublock)},
+		{Name: "command_rusage_context_switches_total", Labels: map[string]string{"type": "voluntary"}, Value: float64(rusage.Nvcsw)},
+		{Name: "command_rusage_context_switches_total", Labels: map[string]string{"type": "involuntary"}, Value: float64(rusage.Nivcsw)},
+	}
+}
+
+// Short description of the resource usage, for the command end annotation
+func rusageText(rusage *syscall.Rusage) string {
+	if rusage == nil {
+		return ""
+	}
+	parts := []string{
+		fmt.Sprintf("user %.3fs", timevalSeconds(rusage.Utime)),
+		fmt.Sprintf("system %.3fs", timevalSeconds(rusage.Stime)),
+		fmt.Sprintf("maxrss %.1f MiB (including statexec)", rusageMaxrssBytes(rusage)/1024/1024),
+		fmt.Sprintf("page faults %d minor / %d major", rusage.Minflt, rusage.Majflt),
+		fmt.Sprintf("block I/O %d in / %d out", rusage.Inblock, rusage.Oublock),
+		fmt.Sprintf("context switches %d voluntary / %d involuntary", rusage.Nvcsw, rusage.Nivcsw),
+	}
+	return strings.Join(parts, ", ")
+}
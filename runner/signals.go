@@ -0,0 +1,49 @@
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Signals that can be configured by name, with or without the SIG prefix
+var signalsByName = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+}
+
+// Parse a signal name (TERM, SIGTERM) or number (15)
+func ParseSignal(value string) (syscall.Signal, error) {
+	if number, err := strconv.Atoi(value); err == nil && number > 0 {
+		return syscall.Signal(number), nil
+	}
+	if sig, ok := signalsByName[strings.TrimPrefix(strings.ToUpper(value), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", value)
+}
+
+// Name of a signal as used in annotations, e.g. SIGTERM
+func SignalName(sig syscall.Signal) string {
+	for name, knownSig := range signalsByName {
+		if knownSig == sig {
+			return "SIG" + name
+		}
+	}
+	return "signal " + strconv.Itoa(int(sig))
+}
+
+// Send a signal to the command, or to its whole process group when it runs in its own
+func signalCommand(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		return syscall.Kill(-cmd.Process.Pid, sig)
+	}
+	return cmd.Process.Signal(sig)
+}
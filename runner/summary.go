@@ -0,0 +1,195 @@
+package runner
+
+import (
+	"math"
+	"sort"
+
+	"github.com/blackswifthosting/statexec/collectors"
+)
+
+// Gauges averaged over the command execution, and their summary name
+var summaryMeanGauges = map[string]string{
+	"memory_used_bytes":                 "summary_memory_used_bytes",
+	"memory_free_bytes":                 "summary_memory_free_bytes",
+	"memory_buffers_bytes":              "summary_memory_buffers_bytes",
+	"memory_cached_bytes":               "summary_memory_cached_bytes",
+	"process_resident_memory_bytes":     "summary_process_resident_memory_bytes",
+	"process_proportional_memory_bytes": "summary_process_proportional_memory_bytes",
+}
+
+// Metric families of the summary
+var summaryMetricDescs = []collectors.MetricDesc{
+	{Name: "summary_cpu_mean_seconds", Help: "Mean CPU time per second while the command was running, summed over cores, by mode", Type: collectors.TypeGauge},
+	{Name: "summary_cpu_cores", Help: "Number of CPU cores", Type: collectors.TypeGauge},
+	{Name: "summary_memory_used_bytes", Help: "Mean used memory while the command was running in bytes", Type: collectors.TypeGauge},
+	{Name: "summary_memory_free_bytes", Help: "Mean free memory while the command was running in bytes", Type: collectors.TypeGauge},
+	{Name: "summary_memory_buffers_bytes", Help: "Mean buffers memory while the command was running in bytes", Type: collectors.TypeGauge},
+	{Name: "summary_memory_cached_bytes", Help: "Mean cached memory while the command was running in bytes", Type: collectors.TypeGauge},
+	{Name: "summary_memory_total_bytes", Help: "Total memory in bytes", Type: collectors.TypeGauge},
+	{Name: "summary_network_mean_sent_bytes_per_second", Help: "Mean bytes sent per second over all interfaces while the command was running", Type: collectors.TypeGauge},
+	{Name: "summary_network_mean_received_bytes_per_second", Help: "Mean bytes received per second over all interfaces while the command was running", Type: collectors.TypeGauge},
+	{Name: "summary_disk_mean_read_bytes_per_second", Help: "Mean bytes read per second over all disks while the command was running", Type: collectors.TypeGauge},
+	{Name: "summary_disk_mean_write_bytes_per_second", Help: "Mean bytes written per second over all disks while the command was running", Type: collectors.TypeGauge},
+	{Name: "summary_process_resident_memory_bytes", Help: "Mean resident memory of the process tree of the command in bytes", Type: collectors.TypeGauge},
+	{Name: "summary_process_proportional_memory_bytes", Help: "Mean proportional memory of the process tree of the command in bytes", Type: collectors.TypeGauge},
+	{Name: "summary_process_max_resident_memory_bytes", Help: "Maximum resident memory of the process tree of the command in bytes", Type: collectors.TypeGauge},
+	{Name: "summary_process_cpu_mean_seconds", Help: "Mean CPU time per second of the process tree of the command, by mode", Type: collectors.TypeGauge},
+	{Name: "summary_process_mean_read_bytes_per_second", Help: "Mean bytes read per second by the process tree of the command", Type: collectors.TypeGauge},
+	{Name: "summary_process_mean_write_bytes_per_second", Help: "Mean bytes written per second by the process tree of the command", Type: collectors.TypeGauge},
+	{Name: "summary_process_mean_context_switches_per_second", Help: "Mean context switches per second of the process tree of the command, by type", Type: collectors.TypeGauge},
+}
+
+// Summary of metrics while the command was running, computed incrementally
+// so that metrics do not have to be kept in memory.
+type runSummary struct {
+	first *InstantMetric // First metric while the command was running
+	last  *InstantMetric // First metric once the command was done
+
+	// Process tree metrics are only collected while the command is running
+	firstProcess       *InstantMetric
+	lastProcess        *InstantMetric
+	processMaxResident float64
+
+	gaugeSums   map[string]float64
+	gaugeCounts map[string]int
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{
+		gaugeSums:   make(map[string]float64),
+		gaugeCounts: make(map[string]int),
+	}
+}
+
+// Sum values of a metric family, grouped by the value of a label (empty to sum all samples together)
+func sumSamples(samples []collectors.Sample, name string, groupBy string) map[string]float64 {
+	sums := make(map[string]float64)
+	for _, sample := range samples {
+		if sample.Name == name {
+			sums[sample.Labels[groupBy]] += sample.Value
+		}
+	}
+	return sums
+}
+
+// Keys of a map in a stable order
+func sortedKeys(values map[string]float64) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Account for a collected metric, metrics must be observed in time order
+func (s *runSummary) observe(metric InstantMetric) {
+	if s.first == nil {
+		if metric.CommandStatus != CommandStatusRunning {
+			return
+		}
+		s.first = &metric
+	}
+	if s.last != nil {
+		return
+	}
+	if metric.CommandStatus == CommandStatusDone {
+		s.last = &metric
+	}
+
+	for name := range summaryMeanGauges {
+		if values := sumSamples(metric.Samples, name, ""); len(values) > 0 {
+			s.gaugeSums[name] += values[""]
+			s.gaugeCounts[name]++
+		}
+	}
+
+	if resident := sumSamples(metric.Samples, "process_resident_memory_bytes", ""); len(resident) > 0 {
+		if s.firstProcess == nil {
+			s.firstProcess = &metric
+		}
+		s.lastProcess = &metric
+		s.processMaxResident = math.Max(s.processMaxResident, resident[""])
+	}
+}
+
+// Timestamp of the summary, the time at which the command was seen done
+func (s *runSummary) timestamp() int64 {
+	if s.last == nil {
+		return 0
+	}
+	return s.last.Timestamp
+}
+
+// Summary samples, none until the command was seen both running and done
+func (s *runSummary) compute() []collectors.Sample {
+	var summary []collectors.Sample
+	if s.first == nil || s.last == nil {
+		return summary
+	}
+
+	// Mean rate of a counter between two metrics, grouped by label
+	addMeanRates := func(name string, groupBy string, summaryName string, startMetric *InstantMetric, stopMetric *InstantMetric) {
+		durationSeconds := float64(stopMetric.Timestamp-startMetric.Timestamp) / 1000.0
+		if durationSeconds <= 0 {
+			return
+		}
+		sumStart := sumSamples(startMetric.Samples, name, groupBy)
+		sumStop := sumSamples(stopMetric.Samples, name, groupBy)
+		for _, group := range sortedKeys(sumStop) {
+			var labels map[string]string
+			if groupBy != "" {
+				labels = map[string]string{groupBy: group}
+			}
+			summary = append(summary, collectors.Sample{
+				Name:   summaryName,
+				Labels: labels,
+				Value:  (sumStop[group] - sumStart[group]) / durationSeconds,
+			})
+		}
+	}
+
+	// Mean value of a gauge over all metrics
+	addMean := func(name string) {
+		if s.gaugeCounts[name] > 0 {
+			summary = append(summary, collectors.Sample{Name: summaryMeanGauges[name], Value: s.gaugeSums[name] / float64(s.gaugeCounts[name])})
+		}
+	}
+
+	// CPU usage
+	addMeanRates("cpu_seconds_total", "mode", "summary_cpu_mean_seconds", s.first, s.last)
+	if cores := sumSamples(s.first.Samples, "cpu_seconds_total", "cpu"); len(cores) > 0 {
+		summary = append(summary, collectors.Sample{Name: "summary_cpu_cores", Value: float64(len(cores))})
+	}
+
+	// Memory usage
+	addMean("memory_used_bytes")
+	addMean("memory_free_bytes")
+	addMean("memory_buffers_bytes")
+	addMean("memory_cached_bytes")
+	if memoryTotal := sumSamples(s.last.Samples, "memory_total_bytes", ""); len(memoryTotal) > 0 {
+		summary = append(summary, collectors.Sample{Name: "summary_memory_total_bytes", Value: memoryTotal[""]})
+	}
+
+	// Network counters
+	addMeanRates("network_sent_bytes_total", "", "summary_network_mean_sent_bytes_per_second", s.first, s.last)
+	addMeanRates("network_received_bytes_total", "", "summary_network_mean_received_bytes_per_second", s.first, s.last)
+
+	// Disk monitoring
+	addMeanRates("disk_read_bytes_total", "", "summary_disk_mean_read_bytes_per_second", s.first, s.last)
+	addMeanRates("disk_write_bytes_total", "", "summary_disk_mean_write_bytes_per_second", s.first, s.last)
+
+	// Process tree
+	if s.firstProcess != nil {
+		addMean("process_resident_memory_bytes")
+		addMean("process_proportional_memory_bytes")
+		summary = append(summary, collectors.Sample{Name: "summary_process_max_resident_memory_bytes", Value: s.processMaxResident})
+
+		addMeanRates("process_cpu_seconds_total", "mode", "summary_process_cpu_mean_seconds", s.firstProcess, s.lastProcess)
+		addMeanRates("process_read_bytes_total", "", "summary_process_mean_read_bytes_per_second", s.firstProcess, s.lastProcess)
+		addMeanRates("process_write_bytes_total", "", "summary_process_mean_write_bytes_per_second", s.firstProcess, s.lastProcess)
+		addMeanRates("process_context_switches_total", "type", "summary_process_mean_context_switches_per_second", s.firstProcess, s.lastProcess)
+	}
+
+	return summary
+}
@@ -0,0 +1,330 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Threads of the trace, shown as tracks
+const (
+	traceTidCommand int = 1
+	traceTidSync    int = 2
+)
+
+// End of the trace file, after the last event
+const traceEnd string = "\n]}\n"
+
+// TraceWriter writes the timeline of the run in Chrome Trace Event format,
+// for ui.perfetto.dev or chrome://tracing: counter tracks for CPU, memory,
+// network and disk per collection, duration events for the command, the
+// delays and the sync requests, and annotations as instant events. Events
+// are written to the file as they come, viewers sort them by time.
+type TraceWriter struct {
+	Version string // Version of statexec, written in the trace metadata
+
+	mutex     sync.Mutex
+	path      string
+	info      RunInfo
+	realStart int64 // Real start of the run in milliseconds
+	file      *lineFile
+	events    int            // Events written to the file
+	spans     []traceEvent   // Spans recorded before the run, written once it starts
+	previous  *InstantMetric // Previous collection, for rates, and end of the run
+	closed    bool
+}
+
+// An event of the Trace Event format, timestamps in microseconds
+type traceEvent struct {
+	Name  string         `json:"name"`
+	Cat   string         `json:"cat,omitempty"`
+	Phase string         `json:"ph"`
+	Ts    int64          `json:"ts"`
+	Dur   int64          `json:"dur,omitempty"`
+	Pid   int            `json:"pid"`
+	Tid   int            `json:"tid"`
+	Scope string         `json:"s,omitempty"`
+	Args  map[string]any `json:"args,omitempty"`
+}
+
+func NewTraceWriter(path string) *TraceWriter {
+	return &TraceWriter{Version: "dev", path: path}
+}
+
+// Record a duration event on the sync track, e.g. a sync request. Spans
+// recorded before the run are kept until it starts, spans recorded once it
+// is over are appended to the file.
+func (w *TraceWriter) Span(name string, start time.Time, end time.Time) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	span := newSpan(name, "sync", traceTidSync, start.UnixMicro(), end.UnixMicro(), nil)
+	switch {
+	case w.closed:
+		return w.appendAfterClose(span)
+	case w.file == nil:
+		w.spans = append(w.spans, span)
+		return nil
+	default:
+		return w.add(span)
+	}
+}
+
+func newSpan(name string, category string, tid int, start int64, end int64, args map[string]any) traceEvent {
+	return traceEvent{
+		Name:  name,
+		Cat:   category,
+		Phase: "X",
+		Ts:    start,
+		Dur:   max(end-start, 1),
+		Pid:   1,
+		Tid:   tid,
+		Args:  args,
+	}
+}
+
+// Render an event as an element of the traceEvents array
+func (w *TraceWriter) render(event traceEvent) (string, error) {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return "", fmt.Errorf("marshalling trace event: %w", err)
+	}
+	separator := ",\n"
+	if w.events == 0 {
+		separator = "\n"
+	}
+	w.events++
+	return separator + string(content), nil
+}
+
+// Write an event to the file
+func (w *TraceWriter) add(event traceEvent) error {
+	line, err := w.render(event)
+	if err != nil {
+		return err
+	}
+	if err := w.file.write(line); err != nil {
+		return fmt.Errorf("writing trace file: %w", err)
+	}
+	return nil
+}
+
+// Insert an event before the end of a closed trace file
+func (w *TraceWriter) appendAfterClose(event traceEvent) error {
+	line, err := w.render(event)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("writing trace file: %w", err)
+	}
+	stat, err := file.Stat()
+	if err == nil {
+		_, err = file.WriteAt([]byte(line+traceEnd), max(stat.Size()-int64(len(traceEnd)), 0))
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing trace file: %w", err)
+	}
+	return nil
+}
+
+// Create the trace file, and write its metadata and the spans recorded so far
+func (w *TraceWriter) Start(info RunInfo) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.info = info
+	w.realStart = time.Now().UnixMilli()
+	w.previous = nil
+	w.closed = false
+	w.events = 0
+
+	file, err := createLineFile(w.path)
+	if err != nil {
+		return fmt.Errorf("creating trace file: %w", err)
+	}
+	w.file = file
+	otherData, err := json.Marshal(map[string]any{
+		"version":  w.Version,
+		"job":      info.Job,
+		"instance": info.Instance,
+		"role":     info.Role,
+		"interval": info.Interval.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("marshalling trace: %w", err)
+	}
+	if err := w.file.write(`{"displayTimeUnit":"ms","otherData":` + string(otherData) + `,"traceEvents":[`); err != nil {
+		w.file.close()
+		return fmt.Errorf("writing trace file: %w", err)
+	}
+
+	events := []traceEvent{
+		{Name: "process_name", Phase: "M", Pid: 1, Args: map[string]any{"name": fmt.Sprintf("statexec %s (%s)", info.Instance, info.Role)}},
+		{Name: "thread_name", Phase: "M", Pid: 1, Tid: traceTidCommand, Args: map[string]any{"name": "command"}},
+		{Name: "thread_name", Phase: "M", Pid: 1, Tid: traceTidSync, Args: map[string]any{"name": "sync"}},
+	}
+	for _, event := range append(events, w.spans...) {
+		if err := w.add(event); err != nil {
+			w.file.close()
+			return err
+		}
+	}
+	w.spans = nil
+	if err := w.file.flush(); err != nil {
+		w.file.close()
+		return fmt.Errorf("writing trace file: %w", err)
+	}
+	return nil
+}
+
+// Real time of a metric timestamp, in microseconds
+func (w *TraceWriter) micros(timestamp int64) int64 {
+	return (w.realStart + timestamp - w.info.StartTime) * 1000
+}
+
+func (w *TraceWriter) addCounter(name string, timestamp int64, values map[string]float64) error {
+	if len(values) == 0 {
+		return nil
+	}
+	args := make(map[string]any, len(values))
+	for key, value := range values {
+		args[key] = value
+	}
+	return w.add(traceEvent{Name: name, Phase: "C", Ts: w.micros(timestamp), Pid: 1, Args: args})
+}
+
+func (w *TraceWriter) WriteMetric(metric InstantMetric) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if used := sumSamples(metric.Samples, "memory_used_bytes", ""); len(used) > 0 {
+		if err := w.addCounter("Memory used (bytes)", metric.Timestamp, map[string]float64{"used": used[""]}); err != nil {
+			return err
+		}
+	}
+
+	previous := w.previous
+	w.previous = &metric
+	if previous == nil || metric.Timestamp <= previous.Timestamp {
+		return nil
+	}
+	seconds := float64(metric.Timestamp-previous.Timestamp) / 1000
+
+	// Share of the CPU time of all cores spent in each mode but idle
+	cpuStart := sumSamples(previous.Samples, "cpu_seconds_total", "mode")
+	cpuStop := sumSamples(metric.Samples, "cpu_seconds_total", "mode")
+	total := 0.0
+	for mode, value := range cpuStop {
+		total += value - cpuStart[mode]
+	}
+	if total > 0 {
+		utilization := make(map[string]float64)
+		for mode, value := range cpuStop {
+			if mode != "idle" {
+				utilization[mode] = (value - cpuStart[mode]) / total * 100
+			}
+		}
+		if err := w.addCounter("CPU utilization (%)", metric.Timestamp, utilization); err != nil {
+			return err
+		}
+	}
+
+	// Rates of counters summed over interfaces or disks
+	rates := func(names map[string]string) map[string]float64 {
+		values := make(map[string]float64)
+		for key, name := range names {
+			start := sumSamples(previous.Samples, name, "")
+			stop := sumSamples(metric.Samples, name, "")
+			if len(start) > 0 && len(stop) > 0 {
+				values[key] = (stop[""] - start[""]) / seconds
+			}
+		}
+		return values
+	}
+	if err := w.addCounter("Network (bytes/s)", metric.Timestamp, rates(map[string]string{
+		"received": "network_received_bytes_total",
+		"sent":     "network_sent_bytes_total",
+	})); err != nil {
+		return err
+	}
+	return w.addCounter("Disk (bytes/s)", metric.Timestamp, rates(map[string]string{
+		"read":  "disk_read_bytes_total",
+		"write": "disk_write_bytes_total",
+	}))
+}
+
+// Write the command, delays and annotations, then end the file
+func (w *TraceWriter) Close(result *Result) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// Events are written until the first error, the file is closed anyway
+	var err error
+	add := func(event traceEvent) {
+		if err == nil {
+			err = w.add(event)
+		}
+	}
+	var commandStart, commandDone *Annotation
+	for i, annotation := range result.Annotations {
+		if len(annotation.Tags) > 1 {
+			switch annotation.Tags[1] {
+			case "start":
+				commandStart = &result.Annotations[i]
+			case "done":
+				commandDone = &result.Annotations[i]
+			}
+		}
+		text, _, _ := strings.Cut(annotation.Text, "\n")
+		add(traceEvent{
+			Name:  text,
+			Cat:   "annotation",
+			Phase: "i",
+			Ts:    w.micros(annotation.Time),
+			Pid:   1,
+			Tid:   traceTidCommand,
+			Scope: "g",
+			Args:  map[string]any{"text": annotation.Text, "tags": annotation.Tags},
+		})
+	}
+
+	runStart := w.micros(w.info.StartTime)
+	runEnd := w.micros(max(result.Timestamp, w.info.StartTime))
+	if w.previous != nil {
+		runEnd = max(runEnd, w.micros(w.previous.Timestamp))
+	}
+	if commandStart != nil {
+		start := w.micros(commandStart.Time)
+		if start > runStart {
+			add(newSpan("Before command", "delay", traceTidCommand, runStart, start, nil))
+		}
+		end := runEnd
+		if commandDone != nil {
+			end = w.micros(commandDone.Time)
+		}
+		add(newSpan(strings.Join(w.info.Command, " "), "command", traceTidCommand, start, end, map[string]any{
+			"exitCode":    result.ExitCode,
+			"timedOut":    result.TimedOut,
+			"interrupted": result.Interrupted,
+		}))
+		if end < runEnd {
+			add(newSpan("After command", "delay", traceTidCommand, end, runEnd, nil))
+		}
+	}
+
+	w.closed = true
+	writeErr := w.file.write(traceEnd)
+	if closeErr := w.file.close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	if err == nil && writeErr != nil {
+		err = fmt.Errorf("writing trace file: %w", writeErr)
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package runner
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blackswifthosting/statexec/collectors"
+)
+
+// The streamed trace is valid JSON once closed, with the spans recorded
+// before the run starts and after it is over
+func TestTraceWriterStreamsEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	writer := NewTraceWriter(path)
+	now := time.Now()
+	if err := writer.Span("Start sync request", now.Add(-time.Second), now); err != nil {
+		t.Fatal(err)
+	}
+	info := testRunInfo()
+	info.Command = []string{"sleep", "2"}
+	if err := writer.Start(info); err != nil {
+		t.Fatal(err)
+	}
+	for second := int64(0); second < 3; second++ {
+		metric := testMetric(second)
+		metric.Samples = append(metric.Samples, collectors.Sample{Name: "cpu_seconds_total", Labels: map[string]string{"cpu": "0", "mode": "idle"}, Value: float64(second * 3)})
+		if err := writer.WriteMetric(metric); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result := &Result{
+		Annotations: []Annotation{
+			{Time: info.StartTime, Text: "Command started", Tags: []string{"statexec", "start"}},
+			{Time: info.StartTime + 2000, Text: "Command done with status 0", Tags: []string{"statexec", "done"}},
+		},
+		Timestamp: info.StartTime + 2000,
+	}
+	if err := writer.Close(result); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Span("Stop sync request", now, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []traceEvent   `json:"traceEvents"`
+		OtherData   map[string]any `json:"otherData"`
+	}
+	if err := json.Unmarshal(content, &trace); err != nil {
+		t.Fatalf("invalid trace: %v\n%s", err, content)
+	}
+	if trace.OtherData["instance"] != "host" {
+		t.Fatalf("unexpected metadata %v", trace.OtherData)
+	}
+	count := make(map[string]int)
+	for _, event := range trace.TraceEvents {
+		count[event.Name]++
+	}
+	for name, expected := range map[string]int{
+		"thread_name":         2,
+		"Start sync request":  1,
+		"CPU utilization (%)": 2,
+		"Command started":     1,
+		"sleep 2":             1,
+		"Stop sync request":   1,
+	} {
+		if count[name] != expected {
+			t.Fatalf("%d events %q, expected %d in %v", count[name], name, expected, count)
+		}
+	}
+}
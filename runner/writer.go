@@ -0,0 +1,106 @@
+package runner
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blackswifthosting/statexec/collectors"
+	"github.com/blackswifthosting/statexec/promfile"
+)
+
+// Run details handed to writers before the first metric
+type RunInfo struct {
+	Job       string
+	Instance  string
+	Role      string
+	Labels    map[string]string // Extra labels
+	Interval  time.Duration
+	StartTime int64                   // Metrics start time in milliseconds
+	Command   []string                // Command and its arguments
+	Descs     []collectors.MetricDesc // Metric families, without the statexec_ prefix
+}
+
+// A Writer receives the metrics of a run as they are collected. Calls are
+// serialized: Start, WriteMetric for every collection, then Close with the
+// result of the run.
+type Writer interface {
+	Start(info RunInfo) error
+	WriteMetric(metric InstantMetric) error
+	Close(result *Result) error
+}
+
+// Render labels in prometheus format: instance, job and role, then labels
+// of the sample, then extra labels, each sorted by name
+func renderLabels(info RunInfo, metricsLabels map[string]string) string {
+	result := []string{
+		renderLabel("instance", info.Instance),
+		renderLabel("job", info.Job),
+		renderLabel("role", info.Role),
+	}
+	for _, labels := range []map[string]string{metricsLabels, info.Labels} {
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			result = append(result, renderLabel(key, labels[key]))
+		}
+	}
+	return strings.Join(result, ",")
+}
+
+func renderLabel(name string, value string) string {
+	return name + "=\"" + promfile.EscapeLabelValue(value) + "\""
+}
+
+// All samples of a collection: command status, collectors and self monitoring
+func metricSamples(metric InstantMetric) []collectors.Sample {
+	timedOut := 0.0
+	if metric.TimedOut {
+		timedOut = 1
+	}
+	samples := []collectors.Sample{
+		{Name: "command_status", Value: float64(metric.CommandStatus)},
+		{Name: "command_timed_out", Value: timedOut},
+	}
+	samples = append(samples, metric.Samples...)
+	return append(samples,
+		collectors.Sample{Name: "time_since_start_ms", Value: float64(metric.MsSinceStart)},
+		collectors.Sample{Name: "metric_collect_duration_ms", Value: float64(metric.CollectDuration)},
+	)
+}
+
+// MemoryWriter keeps every collected metric in memory, e.g. for tests
+// running statexec in process. Fields can be read once Run returned.
+type MemoryWriter struct {
+	mutex   sync.Mutex
+	Info    RunInfo
+	Metrics []InstantMetric
+	Result  *Result
+}
+
+func (w *MemoryWriter) Start(info RunInfo) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.Info = info
+	w.Metrics = nil
+	w.Result = nil
+	return nil
+}
+
+func (w *MemoryWriter) WriteMetric(metric InstantMetric) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.Metrics = append(w.Metrics, metric)
+	return nil
+}
+
+func (w *MemoryWriter) Close(result *Result) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.Result = result
+	return nil
+}
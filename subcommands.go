@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/blackswifthosting/statexec/promfile"
+)
+
+type subcommand struct {
+	name string
+	args string
+	help string
+	run  func(args []string) int // Returns the exit code of statexec
+}
+
+var subcommands []subcommand
+
+func init() {
+	subcommands = []subcommand{
+		{name: "run", args: "[OPTIONS] <command> [command args]", help: "Run a command and collect metrics (standalone mode)",
+			run: func(args []string) int { return runCommand(args, "standalone") }},
+		{name: "serve", args: "[OPTIONS] <command> [command args]", help: "Wait for a client to start the command (server mode)",
+			run: func(args []string) int { return runCommand(args, "server") }},
+		{name: "connect", args: "<ip> [OPTIONS] <command> [command args]", help: "Start the command along with a server on <ip> (client mode)",
+			run: runConnect},
+		{name: "report", args: "[-o <file.html>] <file.prom>...", help: "Print the metadata, annotations and summary of runs, or write them with charts to an offline HTML file",
+			run: runReport},
+		{name: "merge", args: "[-o <file>] <file.prom>...", help: "Merge metrics files, e.g. of a server and a client, to stdout or a file",
+			run: runMerge},
+		{name: "import", args: "[--vm-url <url>] [--grafana-url <url>] [--grafana-token <token>] [--wait <duration>] <file.prom|dir>...",
+			help: "Import metrics into VictoriaMetrics and annotations into Grafana, print dashboard URLs",
+			run:  runImport},
+		{name: "validate", args: "<file.prom>...", help: "Check that metrics files are well formed",
+			run: runValidate},
+	}
+}
+
+func findSubcommand(name string) *subcommand {
+	for i := range subcommands {
+		if subcommands[i].name == name {
+			return &subcommands[i]
+		}
+	}
+	return nil
+}
+
+// Print the usage of an offline subcommand on --help, returns false when args are not a help request
+func subcommandHelp(name string, args []string) bool {
+	if len(args) == 0 || (args[0] != "-h" && args[0] != "--help") {
+		return false
+	}
+	subcommand := findSubcommand(name)
+	fmt.Printf("Usage: %s %s %s\n", os.Args[0], subcommand.name, subcommand.args)
+	fmt.Println(subcommand.help)
+	return true
+}
+
+func runConnect(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		if len(args) > 0 && (args[0] == "-h" || args[0] == "--help") {
+			usage()
+			return 0
+		}
+		fmt.Println("Error: missing server address, usage: connect <ip> [OPTIONS] <command>")
+		return 1
+	}
+	// The server address is a flag, taking precedence over the environment and configuration file
+	return runCommand(append([]string{"--connect", args[0]}, args[1:]...), "client")
+}
+
+// Read metrics files given as arguments, reporting errors
+func readPromFiles(paths []string) ([]*promfile.File, bool) {
+	if len(paths) == 0 {
+		fmt.Println("Error: missing metrics file")
+		return nil, false
+	}
+	var files []*promfile.File
+	for _, path := range paths {
+		file, err := promfile.ReadFile(path)
+		if err != nil {
+			fmt.Println("Error reading metrics file:", err)
+			return nil, false
+		}
+		files = append(files, file)
+	}
+	return files, true
+}
+
+func runMerge(args []string) int {
+	if subcommandHelp("merge", args) {
+		return 0
+	}
+	output := ""
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-o", "--output":
+			if i+1 >= len(args) {
+				fmt.Println("Error: missing value for option", args[i])
+				return 1
+			}
+			i++
+			output = args[i]
+		default:
+			paths = append(paths, args[i])
+		}
+	}
+
+	files, ok := readPromFiles(paths)
+	if !ok {
+		return 1
+	}
+
+	merged := mergePromFiles(files)
+	merged.Header["Merged"] = strings.Join(paths, ", ")
+
+	writer := os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			fmt.Println("Error creating merged file:", err)
+			return 1
+		}
+		defer file.Close()
+		writer = file
+	}
+	if err := merged.Write(writer); err != nil {
+		fmt.Println("Error writing merged file:", err)
+		return 1
+	}
+	return 0
+}
+
+// Merge metrics files, samples and annotations are sorted by time
+func mergePromFiles(files []*promfile.File) *promfile.File {
+	merged := &promfile.File{Header: make(map[string]string)}
+	for key, value := range files[0].Header {
+		merged.Header[key] = value
+	}
+	if len(files) == 1 {
+		merged.Config = files[0].Config
+	}
+
+	declared := make(map[string]bool)
+	for _, file := range files {
+		for _, family := range file.Families {
+			if !declared[family.OpenMetricsName()] {
+				declared[family.OpenMetricsName()] = true
+				merged.Families = append(merged.Families, family)
+			}
+		}
+		merged.Samples = append(merged.Samples, file.Samples...)
+		merged.Annotations = append(merged.Annotations, file.Annotations...)
+	}
+
+	sort.SliceStable(merged.Samples, func(i, j int) bool {
+		return merged.Samples[i].Timestamp < merged.Samples[j].Timestamp
+	})
+	sort.SliceStable(merged.Annotations, func(i, j int) bool {
+		return merged.Annotations[i].Time < merged.Annotations[j].Time
+	})
+	return merged
+}
+
+func runValidate(args []string) int {
+	if subcommandHelp("validate", args) {
+		return 0
+	}
+	if len(args) == 0 {
+		fmt.Println("Error: missing metrics file")
+		return 1
+	}
+
+	exitCode := 0
+	for _, path := range args {
+		file, err := promfile.ReadFile(path)
+		if err != nil {
+			fmt.Printf("%s: error: %s\n", path, err)
+			exitCode = 1
+			continue
+		}
+		errors, warnings := validatePromFile(file)
+		for _, warning := range warnings {
+			fmt.Printf("%s: warning: %s\n", path, warning)
+		}
+		for _, err := range errors {
+			fmt.Printf("%s: error: %s\n", path, err)
+		}
+		if len(errors) > 0 {
+			exitCode = 1
+			continue
+		}
+		fmt.Printf("%s: OK, %d samples, %d annotations\n", path, len(file.Samples), len(file.Annotations))
+	}
+	return exitCode
+}
+
+// Check the consistency of a parsed metrics file
+func validatePromFile(file *promfile.File) (errors []string, warnings []string) {
+	if len(file.Samples) == 0 {
+		errors = append(errors, "no samples")
+	}
+
+	if !file.Complete {
+		warnings = append(warnings, "no # EOF, statexec was killed or the file was written by a previous version")
+	}
+
+	types := make(map[string]string)
+	var undeclared []string
+	lastSamples := make(map[string]promfile.Sample)
+	for _, sample := range file.Samples {
+		if _, ok := types[sample.Name]; !ok {
+			types[sample.Name] = ""
+			if family := file.FamilyOf(sample.Name); family != nil {
+				types[sample.Name] = family.Type
+			} else {
+				undeclared = append(undeclared, sample.Name)
+			}
+		}
+
+		key := sample.SeriesKey()
+		if last, ok := lastSamples[key]; ok {
+			if sample.Timestamp <= last.Timestamp {
+				errors = append(errors, fmt.Sprintf("timestamp %d of %s is not after the previous one (%d)", sample.Timestamp, key, last.Timestamp))
+			}
+			if types[sample.Name] == "counter" && sample.Value < last.Value {
+				errors = append(errors, fmt.Sprintf("counter %s decreases from %v to %v at %d", key, last.Value, sample.Value, sample.Timestamp))
+			}
+		}
+		lastSamples[key] = sample
+	}
+
+	if len(undeclared) > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d metric families have no TYPE: %s", len(undeclared), strings.Join(undeclared, ", ")))
+	}
+
+	for _, annotation := range file.Annotations {
+		if annotation.TimeEnd < annotation.Time {
+			errors = append(errors, fmt.Sprintf("annotation %q ends before it starts", annotation.Text))
+		}
+	}
+	return errors, warnings
+}
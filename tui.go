@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/blackswifthosting/statexec/runner"
+)
+
+const (
+	// Lines of the command output kept for the output pane
+	tuiOutputLines int = 5000
+	// Interval between two refreshes of the screen
+	tuiRefreshInterval time.Duration = 200 * time.Millisecond
+)
+
+// Escape sequences and control characters of the command output, which
+// would break the layout
+var tuiControlSequences = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b[^\[]|[\x00-\x08\x0b-\x1f\x7f]`)
+
+// Live terminal dashboard fed by the collected metrics: CPU per core,
+// memory, network and disk rates, elapsed time and state of the command,
+// with the output of the command in a scrollable pane. It draws on the
+// alternate screen, and restores the terminal when the run is over.
+type tuiDashboard struct {
+	mutex    sync.Mutex
+	info     runner.RunInfo
+	started  time.Time
+	latest   *runner.InstantMetric
+	previous *runner.InstantMetric
+	logFile  string // Output of the command goes there instead of the pane when set
+
+	lines   []string // Complete lines of the command output
+	partial string   // Line being written
+	scroll  int      // Lines scrolled up from the bottom of the output, 0 to follow it
+
+	rows, columns int
+	sttyState     string
+	stop          chan struct{}
+	goroutines    sync.WaitGroup // Refresh loop and key reader, done once stopped
+	restoreOnce   sync.Once
+}
+
+// The screen is drawn on stdout, and keys are read from stdin
+func newTuiDashboard(logFile string) (*tuiDashboard, error) {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return nil, fmt.Errorf("--tui requires a terminal on stdin and stdout")
+	}
+	return &tuiDashboard{logFile: logFile, rows: 24, columns: 80}, nil
+}
+
+// Whether a file is a terminal, stty fails on anything else, e.g. /dev/null
+func isTerminal(file *os.File) bool {
+	cmd := exec.Command("stty", "-g")
+	cmd.Stdin = file
+	return cmd.Run() == nil
+}
+
+// Run stty on the terminal of statexec
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+func (d *tuiDashboard) updateSize() {
+	size, err := stty("size")
+	if err != nil {
+		return
+	}
+	if rows, columns, found := strings.Cut(size, " "); found {
+		d.rows, _ = strconv.Atoi(rows)
+		d.columns, _ = strconv.Atoi(columns)
+	}
+	d.rows = max(d.rows, 10)
+	d.columns = max(d.columns, 40)
+}
+
+// Switch to the alternate screen, read keys without echo, and refresh the
+// screen until the run is over
+func (d *tuiDashboard) Start(info runner.RunInfo) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.info = info
+	d.started = time.Now()
+	d.updateSize()
+
+	state, err := stty("-g")
+	if err != nil {
+		return fmt.Errorf("reading terminal state: %w", err)
+	}
+	d.sttyState = state
+	// Ctrl+C still sends SIGINT, which is forwarded to the command. Reads
+	// return after a tenth of a second without key, for readKeys to stop.
+	if _, err := stty("-icanon", "-echo", "min", "0", "time", "1"); err != nil {
+		return fmt.Errorf("configuring terminal: %w", err)
+	}
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+
+	d.stop = make(chan struct{})
+	d.goroutines.Add(2)
+	go d.readKeys()
+	go d.refreshLoop()
+	return nil
+}
+
+func (d *tuiDashboard) refreshLoop() {
+	defer d.goroutines.Done()
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	defer signal.Stop(resized)
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-resized:
+			d.mutex.Lock()
+			d.updateSize()
+			d.mutex.Unlock()
+		case <-ticker.C:
+		}
+		d.draw()
+	}
+}
+
+// Scroll the output pane with the arrow keys, Page Up/Down, Home and End,
+// until the dashboard is stopped
+func (d *tuiDashboard) readKeys() {
+	defer d.goroutines.Done()
+	buffer := make([]byte, 16)
+	for {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		n, err := os.Stdin.Read(buffer)
+		if err == io.EOF {
+			// No key within the read timeout
+			continue
+		}
+		if err != nil {
+			return
+		}
+		key := string(buffer[:n])
+		d.mutex.Lock()
+		page := max(d.outputHeight()-1, 1)
+		switch key {
+		case "\x1b[A", "k":
+			d.scroll++
+		case "\x1b[B", "j":
+			d.scroll--
+		case "\x1b[5~":
+			d.scroll += page
+		case "\x1b[6~":
+			d.scroll -= page
+		case "\x1b[H", "\x1b[1~", "g":
+			d.scroll = len(d.lines)
+		case "\x1b[F", "\x1b[4~", "G":
+			d.scroll = 0
+		}
+		d.scroll = min(max(d.scroll, 0), max(len(d.lines)-d.outputHeight(), 0))
+		d.mutex.Unlock()
+	}
+}
+
+// Collect the output of the command, line by line
+func (d *tuiDashboard) Write(data []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	text := d.partial + strings.ReplaceAll(string(data), "\t", "    ")
+	lines := strings.Split(text, "\n")
+	d.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		// Progress bars rewrite the line after a carriage return
+		if i := strings.LastIndex(strings.TrimRight(line, "\r"), "\r"); i >= 0 {
+			line = line[i+1:]
+		}
+		d.lines = append(d.lines, tuiControlSequences.ReplaceAllString(line, ""))
+		if d.scroll > 0 {
+			// Keep the scrolled lines in place
+			d.scroll++
+		}
+	}
+	if len(d.lines) > tuiOutputLines {
+		d.lines = d.lines[len(d.lines)-tuiOutputLines:]
+	}
+	return len(data), nil
+}
+
+func (d *tuiDashboard) WriteMetric(metric runner.InstantMetric) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.previous = d.latest
+	d.latest = &metric
+	return nil
+}
+
+// Restore the terminal, then print the output of the command kept by the pane
+func (d *tuiDashboard) Close(*runner.Result) error {
+	d.restore()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.partial != "" {
+		d.lines = append(d.lines, tuiControlSequences.ReplaceAllString(d.partial, ""))
+		d.partial = ""
+	}
+	for _, line := range d.lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// Leave the alternate screen and restore the terminal settings, safe to
+// call several times and before Start
+func (d *tuiDashboard) restore() {
+	d.restoreOnce.Do(func() {
+		if d.stop != nil {
+			close(d.stop)
+			d.goroutines.Wait()
+		}
+		if d.sttyState != "" {
+			fmt.Print("\x1b[?25h\x1b[?1049l")
+			stty(d.sttyState)
+		}
+	})
+}
+
+// Rows left for the output pane
+func (d *tuiDashboard) outputHeight() int {
+	return d.rows - d.headerHeight()
+}
+
+// Rows of everything above the output pane
+func (d *tuiDashboard) headerHeight() int {
+	return 7 + (len(d.cores())+d.barColumns()-1)/d.barColumns()
+}
+
+func (d *tuiDashboard) barColumns() int {
+	return max(1, d.columns/40)
+}
+
+// Names of the CPU cores, in natural order
+func (d *tuiDashboard) cores() []string {
+	if d.latest == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var cores []string
+	for _, sample := range d.latest.Samples {
+		if sample.Name == "cpu_seconds_total" && !seen[sample.Labels["cpu"]] {
+			seen[sample.Labels["cpu"]] = true
+			cores = append(cores, sample.Labels["cpu"])
+		}
+	}
+	sort.Slice(cores, func(i, j int) bool {
+		if len(cores[i]) != len(cores[j]) {
+			return len(cores[i]) < len(cores[j])
+		}
+		return cores[i] < cores[j]
+	})
+	return cores
+}
+
+// Sum of the samples of a family whose labels match, in the latest and previous metrics
+func (d *tuiDashboard) values(name string, match func(labels map[string]string) bool) (float64, float64, bool) {
+	sum := func(metric *runner.InstantMetric) (float64, bool) {
+		total, found := 0.0, false
+		if metric == nil {
+			return 0, false
+		}
+		for _, sample := range metric.Samples {
+			if sample.Name == name && (match == nil || match(sample.Labels)) {
+				total += sample.Value
+				found = true
+			}
+		}
+		return total, found
+	}
+	latest, found := sum(d.latest)
+	previous, foundPrevious := sum(d.previous)
+	return latest, previous, found && foundPrevious
+}
+
+// Per second rate of a counter between the two latest collections
+func (d *tuiDashboard) rate(name string) string {
+	latest, previous, ok := d.values(name, nil)
+	if !ok || d.latest.Timestamp <= d.previous.Timestamp {
+		return "-"
+	}
+	return formatChartValue(max(latest-previous, 0)/(float64(d.latest.Timestamp-d.previous.Timestamp)/1000), "B/s")
+}
+
+// Bar of a ratio between 0 and 1
+func tuiBar(ratio float64, width int) string {
+	filled := min(max(int(ratio*float64(width)+0.5), 0), width)
+	return strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+}
+
+// Cut a line to the width of the terminal
+func tuiFit(line string, width int) string {
+	runes := []rune(line)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return line
+}
+
+func (d *tuiDashboard) draw() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	state := "waiting"
+	if d.latest != nil {
+		switch d.latest.CommandStatus {
+		case runner.CommandStatusPending:
+			state = "pending"
+		case runner.CommandStatusRunning:
+			state = "running"
+		case runner.CommandStatusDone:
+			state = "done"
+		}
+		if d.latest.TimedOut {
+			state += ", timed out"
+		}
+	}
+	elapsed := time.Since(d.started).Round(time.Second)
+	lines := []string{
+		fmt.Sprintf("statexec %s (%s), elapsed %s, command %s", d.info.Instance, d.info.Role, elapsed, state),
+		"$ " + strings.Join(d.info.Command, " "),
+		"",
+	}
+
+	// CPU cores, busy when neither idle nor waiting for I/O
+	cores := d.cores()
+	barColumns := d.barColumns()
+	cellWidth := d.columns / barColumns
+	var row strings.Builder
+	for i, core := range cores {
+		isCore := func(labels map[string]string) bool { return labels["cpu"] == core }
+		isIdle := func(labels map[string]string) bool {
+			return labels["cpu"] == core && (labels["mode"] == "idle" || labels["mode"] == "iowait")
+		}
+		total, previousTotal, ok := d.values("cpu_seconds_total", isCore)
+		idle, previousIdle, _ := d.values("cpu_seconds_total", isIdle)
+		ratio := 0.0
+		if ok && total > previousTotal {
+			ratio = 1 - (idle-previousIdle)/(total-previousTotal)
+		}
+		cell := fmt.Sprintf("%-6s %s %3.0f%%", core, tuiBar(ratio, max(cellWidth-15, 5)), ratio*100)
+		row.WriteString(fmt.Sprintf("%-*s", cellWidth, cell))
+		if (i+1)%barColumns == 0 || i == len(cores)-1 {
+			lines = append(lines, row.String())
+			row.Reset()
+		}
+	}
+
+	used, _, _ := d.values("memory_used_bytes", nil)
+	total, _, _ := d.values("memory_total_bytes", nil)
+	memoryRatio := 0.0
+	if total > 0 {
+		memoryRatio = used / total
+	}
+	lines = append(lines,
+		fmt.Sprintf("Memory %s %s / %s", tuiBar(memoryRatio, max(d.columns-40, 10)), formatChartValue(used, "B"), formatChartValue(total, "B")),
+		fmt.Sprintf("Network  received %-14s sent %s", d.rate("network_received_bytes_total"), d.rate("network_sent_bytes_total")),
+		fmt.Sprintf("Disk     read %-18s written %s", d.rate("disk_read_bytes_total"), d.rate("disk_write_bytes_total")),
+	)
+
+	// Output of the command
+	title := "Output, ↑/↓ PgUp/PgDn g/G to scroll"
+	if d.logFile != "" {
+		title = "Output written to " + d.logFile
+	} else if d.scroll > 0 {
+		title = fmt.Sprintf("Output, %d more lines below", d.scroll)
+	}
+	lines = append(lines, "── "+title+" "+strings.Repeat("─", max(d.columns-len([]rune(title))-4, 0)))
+	height := max(d.rows-len(lines), 0)
+	end := max(len(d.lines)-d.scroll, 0)
+	start := max(end-height, 0)
+	lines = append(lines, d.lines[start:end]...)
+	if d.scroll == 0 && d.partial != "" && len(lines) < d.rows {
+		lines = append(lines, tuiControlSequences.ReplaceAllString(d.partial, ""))
+	}
+
+	var frame bytes.Buffer
+	frame.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i >= d.rows {
+			break
+		}
+		frame.WriteString(tuiFit(line, d.columns) + "\x1b[K")
+		if i < len(lines)-1 && i < d.rows-1 {
+			frame.WriteString("\r\n")
+		}
+	}
+	frame.WriteString("\x1b[J")
+	os.Stdout.Write(frame.Bytes())
+}